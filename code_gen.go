@@ -1,17 +1,35 @@
 package main
 
 import (
+	"flag"
 	"github.com/axw/gollvm/llvm"
 	"llvm_study/frontend"
 	"os"
 )
 
 func main() {
-	infile := os.Args[1]
-	outfile := os.Args[2]
+	var options frontend.Options
+
+	compileOnly := flag.Bool("c", false, "compile a translation unit that is not a whole program; main is not required")
+	options.SetFlags(flag.CommandLine)
+	flag.CommandLine.Parse(frontend.SplitShortFlags(os.Args[1:]))
+
+	infile := flag.Arg(0)
+	outfile := flag.Arg(1)
+
+	parser := frontend.NewParserWithOptions(infile, &options)
+	ok := parser.DoParse()
+
+	if ok && !*compileOnly {
+		ok = parser.CheckMain()
+	}
+
+	frontend.PrintError(os.Stderr, parser.Diagnostics)
+
+	if !ok {
+		os.Exit(1)
+	}
 
-	parser := frontend.NewParser(infile)
-	parser.DoParse()
 	ast := parser.GetAST()
 
 	llvm.InitializeNativeTarget()
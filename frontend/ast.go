@@ -11,31 +11,133 @@ const (
 	CallExprID     AstID = 5
 	NumberID       AstID = 6
 	JumpStmtID     AstID = 7
+	StringID       AstID = 8
+	FunctionRefID  AstID = 9
+	UnaryExprID    AstID = 10
+	AssertStmtID   AstID = 11
+	ErrorID        AstID = 12
 )
 
 type DeclType int
 
 const (
-	Decl_local DeclType = 0
-	Decl_param DeclType = 1
+	Decl_local  DeclType = 0
+	Decl_param  DeclType = 1
+	Decl_global DeclType = 2
 )
 
+type StorageClass int
+
+const (
+	Storage_none   StorageClass = 0
+	Storage_static StorageClass = 1
+	Storage_extern StorageClass = 2
+)
+
+type TypeID int
+
+const (
+	Type_int      TypeID = 0
+	Type_char     TypeID = 1
+	Type_pointer  TypeID = 2
+	Type_function TypeID = 3
+)
+
+// TypeAST describes a type. Elem is the target of a pointer or the return
+// type of a function.
+type TypeAST struct {
+	ID       TypeID
+	Elem     *TypeAST
+	Const    bool
+	Params   []*TypeAST
+	IsVarArg bool
+}
+
+func intType() *TypeAST {
+	return &TypeAST{ID: Type_int}
+}
+
+func pointerTo(elem *TypeAST) *TypeAST {
+	return &TypeAST{ID: Type_pointer, Elem: elem}
+}
+
+func sameType(a *TypeAST, b *TypeAST) bool {
+	return matchType(a, b, false)
+}
+
+// compatibleType is like sameType but ignores const qualifiers.
+func compatibleType(a *TypeAST, b *TypeAST) bool {
+	return matchType(a, b, true)
+}
+
+func matchType(a *TypeAST, b *TypeAST, ignoreConst bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.ID != b.ID || (a.Const != b.Const && !ignoreConst) || !matchType(a.Elem, b.Elem, ignoreConst) ||
+		a.IsVarArg != b.IsVarArg || len(a.Params) != len(b.Params) {
+		return false
+	}
+
+	for i, _ := range a.Params {
+		if !matchType(a.Params[i], b.Params[i], ignoreConst) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func functionTypeOf(proto *PrototypeAST) *TypeAST {
+	return &TypeAST{ID: Type_function, Elem: intType(), Params: proto.ParamTypes, IsVarArg: proto.IsVarArg}
+}
+
+// sameSignature reports whether two prototypes declare the same function
+// type. A qualifier on a parameter itself does not take part in the
+// comparison, so "int f(const int)" agrees with "int f(int i)".
+func sameSignature(a *PrototypeAST, b *PrototypeAST) bool {
+	if a.IsVarArg != b.IsVarArg || len(a.ParamTypes) != len(b.ParamTypes) {
+		return false
+	}
+
+	for i, _ := range a.ParamTypes {
+		aParam, bParam := *a.ParamTypes[i], *b.ParamTypes[i]
+		aParam.Const, bParam.Const = false, false
+
+		if !sameType(&aParam, &bParam) {
+			return false
+		}
+	}
+
+	return true
+}
+
 type AST interface {
 	GetID() AstID
+	GetPos() Pos
 }
 
 func classOf(a AST, b AST) bool {
 	return a.GetID() == b.GetID()
 }
 
+// BaseAST is embedded in every node. Pos is the position of the token the
+// node was parsed from: the operator of an operation, the name of a
+// variable or function, and the first token of anything else.
 type BaseAST struct {
-	ID AstID
+	ID  AstID
+	Pos Pos
 }
 
 func (b *BaseAST) GetID() AstID {
 	return b.ID
 }
 
+func (b *BaseAST) GetPos() Pos {
+	return b.Pos
+}
+
 type VariableAST struct {
 	Name string
 	*BaseAST
@@ -46,6 +148,11 @@ type NumberAST struct {
 	*BaseAST
 }
 
+type StringAST struct {
+	Val string
+	*BaseAST
+}
+
 type BinaryExprAST struct {
 	Op  string
 	LHS AST
@@ -53,15 +160,32 @@ type BinaryExprAST struct {
 	*BaseAST
 }
 
+// CallExprAST calls the function named Callee, or the function pointer Fn
+// evaluates to when Fn is not nil.
 type CallExprAST struct {
 	Callee string
 	Args   []AST
+	Fn     AST
 	*BaseAST
 }
 
-type VariableDeclAST struct {
+type FunctionRefAST struct {
 	Name string
-	Type DeclType
+	*BaseAST
+}
+
+type UnaryExprAST struct {
+	Op      string
+	Operand AST
+	*BaseAST
+}
+
+type VariableDeclAST struct {
+	Name    string
+	Type    DeclType
+	VarType *TypeAST
+	Storage StorageClass
+	Init    AST
 	*BaseAST
 }
 
@@ -70,14 +194,38 @@ type JumpStmtAST struct {
 	*BaseAST
 }
 
+// AssertStmtAST is the builtin assert(expr). File and Line locate the
+// statement in the source, and Text is the asserted expression as written,
+// or the invocation of the macro it was expanded from.
+type AssertStmtAST struct {
+	Expr AST
+	File string
+	Line int
+	Text string
+	*BaseAST
+}
+
+// ErrorAST stands in for a statement or an external declaration that failed
+// to parse, with the message of the error it failed with.
+type ErrorAST struct {
+	Msg string
+	*BaseAST
+}
+
 type FunctionStmtAST struct {
 	VariableDecls []*VariableDeclAST
 	StmtLists     []AST
 }
 
+// PrototypeAST declares a function. Pos is the position of its name; the
+// builtin printnum has none.
 type PrototypeAST struct {
-	Name   string
-	Params []string
+	Name       string
+	Params     []string
+	ParamTypes []*TypeAST
+	IsVarArg   bool
+	Storage    StorageClass
+	Pos        Pos
 }
 
 type FunctionAST struct {
@@ -85,9 +233,13 @@ type FunctionAST struct {
 	Body  *FunctionStmtAST
 }
 
+// TranslationUnitAST holds the external declarations by kind. Errors takes
+// the place of those that failed to parse.
 type TranslationUnitAST struct {
 	Prototypes []*PrototypeAST
 	Functions  []*FunctionAST
+	Variables  []*VariableDeclAST
+	Errors     []*ErrorAST
 }
 
 type NullExprAST struct {
@@ -7,16 +7,20 @@ import (
 )
 
 type CodeGen struct {
-	curFunc     llvm.Value
-	variableMap map[string]llvm.Value
-	module      llvm.Module
-	builder     llvm.Builder
+	curFunc         llvm.Value
+	variableMap     map[string]llvm.Value
+	staticFunctions map[string]bool
+	module          llvm.Module
+	builder         llvm.Builder
 }
 
 func NewCodeGen(c llvm.Context) *CodeGen {
 	builder := c.NewBuilder()
 
-	return &CodeGen{builder: builder, variableMap: make(map[string]llvm.Value)}
+	return &CodeGen{
+		builder:         builder,
+		variableMap:     make(map[string]llvm.Value),
+		staticFunctions: make(map[string]bool)}
 }
 
 func (c *CodeGen) DoCodeGen(tunit *TranslationUnitAST, name string) bool {
@@ -50,6 +54,20 @@ func (c *CodeGen) generateTranslationUnit(tunit *TranslationUnitAST, name string
 		}
 	}
 
+	// declare every function up front so that global initializers can take
+	// their addresses
+	for _, funcAST := range tunit.Functions {
+		if _, ok := c.generatePrototype(funcAST.Proto, c.module); !ok {
+			return false
+		}
+	}
+
+	for _, vdecl := range tunit.Variables {
+		if _, ok := c.generateGlobalVariable(vdecl, vdecl.Name); !ok {
+			return false
+		}
+	}
+
 	for i, _ := range tunit.Functions {
 		funcAST := tunit.Functions[i]
 
@@ -76,24 +94,36 @@ func (c *CodeGen) generatePrototype(proto *PrototypeAST, module llvm.Module) (fu
 		}
 	}
 
-	intArgs := []llvm.Type{}
+	argTypes := []llvm.Type{}
 
-	for i := 0; i < len(proto.Params); i++ {
-		intArgs = append(intArgs, c.context().Int32Type())
+	for _, paramType := range proto.ParamTypes {
+		argTypes = append(argTypes, c.llvmType(paramType))
 	}
 
-	intType := llvm.FunctionType(c.context().Int32Type(), intArgs, false)
+	funcType := llvm.FunctionType(c.context().Int32Type(), argTypes, proto.IsVarArg)
 
-	fun = llvm.AddFunction(module, proto.Name, intType)
+	fun = llvm.AddFunction(module, proto.Name, funcType)
 	fun.SetLinkage(llvm.ExternalLinkage)
 
-	for i, param := range fun.Params() {
-		param.SetName(proto.Params[i] + "_arg")
+	// a declaration keeps external linkage until the function is defined;
+	// LLVM does not allow internal declarations
+	if proto.Storage == Storage_static {
+		c.staticFunctions[proto.Name] = true
 	}
 
+	c.nameParams(fun, proto)
+
 	return fun, true
 }
 
+func (c *CodeGen) nameParams(fun llvm.Value, proto *PrototypeAST) {
+	for i, param := range fun.Params() {
+		if proto.Params[i] != "" {
+			param.SetName(proto.Params[i] + "_arg")
+		}
+	}
+}
+
 func (c *CodeGen) generateFunctionDefinition(funcAST *FunctionAST, module llvm.Module) (value llvm.Value, ok bool) {
 	fun, ok := c.generatePrototype(funcAST.Proto, module)
 
@@ -101,6 +131,13 @@ func (c *CodeGen) generateFunctionDefinition(funcAST *FunctionAST, module llvm.M
 		return value, false
 	}
 
+	// an earlier declaration may have named the parameters differently
+	c.nameParams(fun, funcAST.Proto)
+
+	if funcAST.Proto.Storage == Storage_static || c.staticFunctions[funcAST.Proto.Name] {
+		fun.SetLinkage(llvm.InternalLinkage)
+	}
+
 	c.curFunc = fun
 	c.variableMap = make(map[string]llvm.Value)
 
@@ -109,6 +146,12 @@ func (c *CodeGen) generateFunctionDefinition(funcAST *FunctionAST, module llvm.M
 
 	c.generateFunctionStatement(funcAST.Body)
 
+	// reaching the closing brace of main returns 0 to the host environment
+	if stmts := funcAST.Body.StmtLists; funcAST.Proto.Name == "main" &&
+		(len(stmts) == 0 || stmts[len(stmts)-1].GetID() != JumpStmtID) {
+		c.builder.CreateRet(c.generateNumber(0))
+	}
+
 	return fun, true
 }
 
@@ -126,11 +169,61 @@ func (c *CodeGen) generateFunctionStatement(funcStmt *FunctionStmtAST) llvm.Valu
 	return v
 }
 
+// generateGlobalVariable emits a global named name for vdeclAST. Static
+// locals are emitted this way too, under a name qualified by their function.
+func (c *CodeGen) generateGlobalVariable(vdeclAST *VariableDeclAST, name string) (global llvm.Value, ok bool) {
+	varType := c.llvmType(vdeclAST.VarType)
+	global = c.module.NamedGlobal(name)
+
+	if global.IsNil() {
+		global = llvm.AddGlobal(c.module, varType, name)
+	}
+
+	if vdeclAST.Storage == Storage_static {
+		global.SetLinkage(llvm.InternalLinkage)
+	}
+
+	// constant globals are placed in a read-only section by the backend
+	if vdeclAST.VarType.Const {
+		global.SetGlobalConstant(true)
+	}
+
+	// "extern" without an initializer only declares the variable
+	if vdeclAST.Init != nil && vdeclAST.Init.GetID() == FunctionRefID {
+		global.SetInitializer(c.module.NamedFunction(vdeclAST.Init.(*FunctionRefAST).Name))
+	} else if vdeclAST.Init != nil {
+		val := vdeclAST.Init.(*NumberAST).Val
+
+		if vdeclAST.VarType.ID == Type_pointer && val != 0 {
+			fmt.Fprintf(os.Stderr, "error::invalid initializer for pointer %s", vdeclAST.Name)
+			return global, false
+		}
+
+		global.SetInitializer(c.generateConstant(varType, val))
+	} else if vdeclAST.Storage != Storage_extern && global.Initializer().IsNil() {
+		global.SetInitializer(llvm.ConstNull(varType))
+	}
+
+	return global, true
+}
+
 func (c *CodeGen) generateVariableDeclaration(vdeclAST *VariableDeclAST) llvm.Value {
-	alloca := c.builder.CreateAlloca(c.context().Int32Type(), vdeclAST.Name)
+	if vdeclAST.Storage == Storage_static {
+		global, _ := c.generateGlobalVariable(vdeclAST, c.curFunc.Name()+"."+vdeclAST.Name)
+		c.variableMap[vdeclAST.Name] = global
+
+		return global
+	}
+
+	alloca := c.builder.CreateAlloca(c.llvmType(vdeclAST.VarType), vdeclAST.Name)
 
 	c.variableMap[vdeclAST.Name] = alloca
 
+	if vdeclAST.Init != nil {
+		initV := c.convertValue(c.generateExpression(vdeclAST.Init), alloca.Type().ElementType())
+		c.builder.CreateStore(initV, alloca)
+	}
+
 	if vdeclAST.Type == Decl_param {
 		for _, param := range c.curFunc.Params() {
 			if param.Name() == vdeclAST.Name+"_arg" {
@@ -151,6 +244,8 @@ func (c *CodeGen) generateStatement(stmt AST) (value llvm.Value) {
 		value = c.generateCallExpression(stmt.(*CallExprAST))
 	case JumpStmtID:
 		value = c.generateJumpStatement(stmt.(*JumpStmtAST))
+	case AssertStmtID:
+		value = c.generateAssertStatement(stmt.(*AssertStmtAST))
 	}
 
 	return
@@ -167,32 +262,16 @@ func (c *CodeGen) generateBinaryExpression(binExpr *BinaryExprAST) (value llvm.V
 		fmt.Println("genStore")
 
 		lhsVar := lhs.(*VariableAST)
-		lhsV = c.variableMap[lhsVar.Name]
+		lhsV = c.lookupVariable(lhsVar.Name)
 	} else {
-		// lhs?
-		// binary?
-		switch lhs.GetID() {
-		case BinaryExprID:
-			lhsV = c.generateBinaryExpression(lhs.(*BinaryExprAST))
-		case VariableID:
-			lhsV = c.generateVariable(lhs.(*VariableAST))
-		case NumberID:
-			lhsV = c.generateNumber(lhs.(*NumberAST).Val)
-		}
+		lhsV = c.generateExpression(lhs)
 	}
 
-	switch rhs.GetID() {
-	case BinaryExprID:
-		rhsV = c.generateBinaryExpression(rhs.(*BinaryExprAST))
-	case VariableID:
-		rhsV = c.generateVariable(rhs.(*VariableAST))
-	case NumberID:
-		rhsV = c.generateNumber(rhs.(*NumberAST).Val)
-	}
+	rhsV = c.generateExpression(rhs)
 
 	switch binExpr.Op {
 	case "=":
-		value = c.builder.CreateStore(rhsV, lhsV)
+		value = c.builder.CreateStore(c.convertValue(rhsV, lhsV.Type().ElementType()), lhsV)
 	case "+":
 		value = c.builder.CreateAdd(lhsV, rhsV, "add_tmp")
 	case "-":
@@ -207,53 +286,178 @@ func (c *CodeGen) generateBinaryExpression(binExpr *BinaryExprAST) (value llvm.V
 }
 
 func (c *CodeGen) generateCallExpression(callExpr *CallExprAST) llvm.Value {
-	var argV llvm.Value
+	var fun llvm.Value
+
+	if callExpr.Fn != nil {
+		fun = c.generateExpression(callExpr.Fn)
+	} else {
+		fun = c.module.NamedFunction(callExpr.Callee)
+	}
 
+	funcType := fun.Type().ElementType()
 	argVec := []llvm.Value{}
 
-	for _, arg := range callExpr.Args {
-		switch arg.GetID() {
-		case CallExprID:
-			argV = c.generateCallExpression(arg.(*CallExprAST))
-		case BinaryExprID:
-			binExpr := arg.(*BinaryExprAST)
-			argV = c.generateBinaryExpression(binExpr)
-
-			if binExpr.Op == "=" {
-				variable := binExpr.LHS
-				argV = c.builder.CreateLoad(c.variableMap[variable.(*VariableAST).Name], "arg_val")
-			}
-		case VariableID:
-			argV = c.generateVariable(arg.(*VariableAST))
-		case NumberID:
-			argV = c.generateNumber(arg.(*NumberAST).Val)
+	for i, arg := range callExpr.Args {
+		argV := c.generateExpression(arg)
+
+		// arguments matching the "..." of a variadic callee
+		if i >= funcType.ParamTypesCount() {
+			argV = c.promoteArgument(argV)
+		} else {
+			argV = c.convertValue(argV, funcType.ParamTypes()[i])
 		}
 
 		argVec = append(argVec, argV)
 	}
 
-	return c.builder.CreateCall(c.module.NamedFunction(callExpr.Callee), argVec, "call_tmp")
+	return c.builder.CreateCall(fun, argVec, "call_tmp")
 }
 
-func (c *CodeGen) generateJumpStatement(jumpStmt *JumpStmtAST) llvm.Value {
-	var retV llvm.Value
+// convertValue converts value for storing into a variable of type t. The
+// Checker only lets the null pointer constant 0 turn into a pointer.
+func (c *CodeGen) convertValue(value llvm.Value, t llvm.Type) llvm.Value {
+	if t.TypeKind() == llvm.PointerTypeKind && value.Type().TypeKind() == llvm.IntegerTypeKind {
+		return llvm.ConstPointerNull(t)
+	}
+
+	return value
+}
+
+// promoteArgument applies the default argument promotions, widening
+// integers narrower than int.
+func (c *CodeGen) promoteArgument(value llvm.Value) llvm.Value {
+	valueType := value.Type()
+
+	if valueType.TypeKind() == llvm.IntegerTypeKind && valueType.IntTypeWidth() < 32 {
+		return c.builder.CreateSExt(value, c.context().Int32Type(), "promote_tmp")
+	}
+
+	return value
+}
+
+// generateAssertStatement branches on the asserted value to a block that
+// reports the failure on stderr like the C library's assert and aborts.
+func (c *CodeGen) generateAssertStatement(assertStmt *AssertStmtAST) llvm.Value {
+	value := c.generateExpression(assertStmt.Expr)
+	cond := c.builder.CreateICmp(llvm.IntNE, value, llvm.ConstNull(value.Type()), "assert_cond")
+
+	failBlock := c.context().AddBasicBlock(c.curFunc, "assert_fail")
+	okBlock := c.context().AddBasicBlock(c.curFunc, "assert_ok")
+	c.builder.CreateCondBr(cond, okBlock, failBlock)
+
+	c.builder.SetInsertPointAtEnd(failBlock)
+
+	i32 := c.context().Int32Type()
+	i8ptr := llvm.PointerType(c.context().Int8Type(), 0)
+	dprintf := c.declareFunction("dprintf", llvm.FunctionType(i32, []llvm.Type{i32, i8ptr}, true))
+	abort := c.declareFunction("abort", llvm.FunctionType(c.context().VoidType(), []llvm.Type{}, false))
+
+	c.builder.CreateCall(dprintf, []llvm.Value{
+		c.generateNumber(2),
+		c.builder.CreateGlobalStringPtr("%s:%d: %s: Assertion `%s' failed.\n", "assert_fmt"),
+		c.builder.CreateGlobalStringPtr(assertStmt.File, "assert_file"),
+		c.generateNumber(assertStmt.Line),
+		c.builder.CreateGlobalStringPtr(c.curFunc.Name(), "assert_func"),
+		c.builder.CreateGlobalStringPtr(assertStmt.Text, "assert_expr")}, "")
+	c.builder.CreateCall(abort, []llvm.Value{}, "")
+	c.builder.CreateUnreachable()
+
+	c.builder.SetInsertPointAtEnd(okBlock)
+
+	return value
+}
+
+// declareFunction returns the function called name, adding a declaration of
+// type funcType for it if the module has none yet.
+func (c *CodeGen) declareFunction(name string, funcType llvm.Type) llvm.Value {
+	fun := c.module.NamedFunction(name)
+
+	if fun.IsNil() {
+		fun = llvm.AddFunction(c.module, name, funcType)
+	}
 
-	expr := jumpStmt.Expr
+	return fun
+}
+
+func (c *CodeGen) generateJumpStatement(jumpStmt *JumpStmtAST) llvm.Value {
+	return c.builder.CreateRet(c.generateExpression(jumpStmt.Expr))
+}
 
+// generateExpression returns the value of expr. An assignment evaluates to
+// the value stored.
+func (c *CodeGen) generateExpression(expr AST) (value llvm.Value) {
 	switch expr.GetID() {
 	case BinaryExprID:
-		retV = c.generateBinaryExpression(expr.(*BinaryExprAST))
+		binExpr := expr.(*BinaryExprAST)
+		value = c.generateBinaryExpression(binExpr)
+
+		if binExpr.Op == "=" {
+			variable := binExpr.LHS
+			value = c.builder.CreateLoad(c.lookupVariable(variable.(*VariableAST).Name), "assign_val")
+		}
+	case CallExprID:
+		value = c.generateCallExpression(expr.(*CallExprAST))
 	case VariableID:
-		retV = c.generateVariable(expr.(*VariableAST))
+		value = c.generateVariable(expr.(*VariableAST))
 	case NumberID:
-		retV = c.generateNumber(expr.(*NumberAST).Val)
+		value = c.generateNumber(expr.(*NumberAST).Val)
+	case StringID:
+		value = c.builder.CreateGlobalStringPtr(expr.(*StringAST).Val, "str")
+	case FunctionRefID:
+		value = c.module.NamedFunction(expr.(*FunctionRefAST).Name)
+	case UnaryExprID:
+		unaryExpr := expr.(*UnaryExprAST)
+		value = c.generateExpression(unaryExpr.Operand)
+
+		// "*" applied to a function pointer designates the same function,
+		// so only "-" does anything
+		if unaryExpr.Op == "-" {
+			value = c.builder.CreateNeg(value, "neg_tmp")
+		}
 	}
 
-	return c.builder.CreateRet(retV)
+	return
 }
 
 func (c *CodeGen) generateVariable(variable *VariableAST) llvm.Value {
-	return c.builder.CreateLoad(c.variableMap[variable.Name], "var_tmp")
+	return c.builder.CreateLoad(c.lookupVariable(variable.Name), "var_tmp")
+}
+
+// lookupVariable returns the storage of a local variable, falling back to
+// the global of the same name.
+func (c *CodeGen) lookupVariable(name string) llvm.Value {
+	if v, ok := c.variableMap[name]; ok {
+		return v
+	}
+
+	return c.module.NamedGlobal(name)
+}
+
+func (c *CodeGen) llvmType(typeAST *TypeAST) llvm.Type {
+	switch typeAST.ID {
+	case Type_char:
+		return c.context().Int8Type()
+	case Type_pointer:
+		return llvm.PointerType(c.llvmType(typeAST.Elem), 0)
+	case Type_function:
+		paramTypes := []llvm.Type{}
+
+		for _, paramType := range typeAST.Params {
+			paramTypes = append(paramTypes, c.llvmType(paramType))
+		}
+
+		return llvm.FunctionType(c.llvmType(typeAST.Elem), paramTypes, typeAST.IsVarArg)
+	}
+
+	return c.context().Int32Type()
+}
+
+func (c *CodeGen) generateConstant(t llvm.Type, value int) llvm.Value {
+	if t.TypeKind() == llvm.PointerTypeKind {
+		return llvm.ConstPointerNull(t)
+	}
+
+	return llvm.ConstInt(t, uint64(value), true)
 }
 
 func (c *CodeGen) generateNumber(value int) llvm.Value {
@@ -0,0 +1,114 @@
+package frontend
+
+import (
+	"github.com/axw/gollvm/llvm"
+	"github.com/coocood/assrt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// irOf compiles src and returns the module generated for it as text.
+func irOf(t *testing.T, src string) string {
+	assert := assrt.NewAssert(t)
+
+	tu, err := ParseString("t.xxx", src, &Options{})
+	assert.MustNil(err, src)
+
+	codeGen := NewCodeGen(llvm.GlobalContext())
+	assert.MustTrue(codeGen.DoCodeGen(tu, "t.xxx"), src)
+
+	module := codeGen.GetModule()
+	defer module.Dispose()
+
+	file, err := ioutil.TempFile("", "ir")
+	assert.MustNil(err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	assert.MustNil(module.PrintToFile(file.Name()))
+	ir, err := ioutil.ReadFile(file.Name())
+	assert.MustNil(err)
+
+	return string(ir)
+}
+
+// checkIR checks that every one of lines is in the module generated for src.
+func checkIR(t *testing.T, src string, lines ...string) {
+	assert := assrt.NewAssert(t)
+	ir := irOf(t, src)
+
+	for _, line := range lines {
+		assert.True(strings.Contains(ir, line), line, ir)
+	}
+}
+
+func TestCodeGenVariadicCalls(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	checkIR(t, "int printf(char *fmt, ...);\nint main(void) {\n  return printf(\"%d %s\\n\", 1, \"a\");\n}\n",
+		"declare i32 @printf(i8*, ...)",
+		"call i32 (i8*, ...) @printf(i8* getelementptr inbounds ([7 x i8], [7 x i8]* @str, i32 0, i32 0), "+
+			"i32 1, i8* getelementptr inbounds ([2 x i8], [2 x i8]* @str.1, i32 0, i32 0))")
+
+	// a char passed for "..." is promoted to int
+	promoted := NewCodeGen(llvm.GlobalContext()).promoteArgument(llvm.ConstInt(llvm.GlobalContext().Int8Type(), 0xff, false))
+	assert.Equal(32, promoted.Type().IntTypeWidth())
+	assert.Equal(int64(-1), promoted.SExtValue())
+}
+
+func TestCodeGenLinkage(t *testing.T) {
+	// a definition keeps the internal linkage of a static prototype, and a
+	// static local is an internal global named after its function
+	checkIR(t, "static int f(int a);\nint f(int a) {\n  return a;\n}\nstatic int g;\nextern int h;\n"+
+		"int main(void) {\n  static int n = 1;\n  return f(n) + g + h;\n}\n",
+		"define internal i32 @f(i32 %a_arg)",
+		"@g = internal global i32 0",
+		"@h = external global i32",
+		"@main.n = internal global i32 1",
+		"define i32 @main()")
+}
+
+func TestCodeGenConst(t *testing.T) {
+	// const globals are LLVM constants, which the backend makes read-only
+	checkIR(t, "const int g = 1;\nint h = 2;\nint main(void) {\n  static const int n = 3;\n  return g + h + n;\n}\n",
+		"@g = constant i32 1",
+		"@h = global i32 2",
+		"@main.n = internal constant i32 3")
+}
+
+func TestCodeGenFunctionPointers(t *testing.T) {
+	add := "int add(int a, int b) {\n  return a + b;\n}\n"
+
+	// the call goes through the loaded pointer, not to @add
+	checkIR(t, add+"int main(void) {\n  int (*op)(int, int) = add;\n  return op(1, 2);\n}\n",
+		"store i32 (i32, i32)* @add, i32 (i32, i32)** %op",
+		"%var_tmp = load i32 (i32, i32)*, i32 (i32, i32)** %op",
+		"call i32 %var_tmp(i32 1, i32 2)")
+	checkIR(t, add+"int (*g)(int, int) = &add;\nint main(void) {\n  return (*g)(1, 2);\n}\n",
+		"@g = global i32 (i32, i32)* @add",
+		"%var_tmp = load i32 (i32, i32)*, i32 (i32, i32)** @g",
+		"call i32 %var_tmp(i32 1, i32 2)")
+}
+
+func TestCodeGenCallsToLaterFunctions(t *testing.T) {
+	// every function is declared before any body is generated
+	checkIR(t, "int even(int n) {\n  return odd(n - 1);\n}\nint odd(int n) {\n  return even(n - 1);\n}\n",
+		"define i32 @even(i32 %n_arg)",
+		"call i32 @odd(i32 %sub_tmp)",
+		"define i32 @odd(i32 %n_arg)",
+		"call i32 @even(i32 %sub_tmp)")
+}
+
+func TestCodeGenParameterLists(t *testing.T) {
+	// "(void)" declares no parameters, and a definition names those its
+	// prototype left unnamed
+	checkIR(t, "int f(int, int);\nint g(void);\nint h(int, char *);\nint f(int a, int b) {\n  return a + b;\n}\n"+
+		"int main(void) {\n  return f(1, 2) + g();\n}\n",
+		"declare i32 @g()",
+		"declare i32 @h(i32, i8*)",
+		"define i32 @f(i32 %a_arg, i32 %b_arg)",
+		"define i32 @main()",
+		"call i32 @g()")
+}
@@ -0,0 +1,156 @@
+package frontend
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Severity_error   Severity = 0
+	Severity_warning Severity = 1
+)
+
+func (s Severity) String() string {
+	if s == Severity_warning {
+		return "warning"
+	}
+
+	return "error"
+}
+
+// Diagnostic is an error or warning about the source at Pos. Every error the
+// frontend finds in a source is reported as one.
+type Diagnostic struct {
+	Pos      Position
+	Severity Severity
+	Msg      string
+}
+
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Msg)
+}
+
+// asDiagnostic returns err as a Diagnostic, without a position if it is not
+// one.
+func asDiagnostic(err error) *Diagnostic {
+	if d, ok := err.(*Diagnostic); ok {
+		return d
+	}
+
+	return &Diagnostic{Severity: Severity_error, Msg: err.Error()}
+}
+
+// DiagnosticList collects the diagnostics of a parse in the order they were
+// found. As an error it stands for its errors; warnings do not fail a parse.
+type DiagnosticList []*Diagnostic
+
+func (list DiagnosticList) Error() string {
+	errs := list.Errors()
+
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
+
+	return fmt.Sprintf("%s (and %d more errors)", errs[0], len(errs)-1)
+}
+
+// Errors returns the diagnostics of error severity.
+func (list DiagnosticList) Errors() DiagnosticList {
+	var errs DiagnosticList
+
+	for _, d := range list {
+		if d.Severity == Severity_error {
+			errs = append(errs, d)
+		}
+	}
+
+	return errs
+}
+
+// PrintError writes err to w, one line for each diagnostic of a
+// DiagnosticList, warnings included.
+func PrintError(w io.Writer, err error) {
+	if list, ok := err.(DiagnosticList); ok {
+		for _, d := range list {
+			fmt.Fprintln(w, d)
+		}
+	} else if err != nil {
+		fmt.Fprintln(w, err)
+	}
+}
+
+// warningQueue holds the warnings found while lexing until the parser
+// reaches them. at is the index of the token each warning was found before.
+type warningQueue struct {
+	Warnings DiagnosticList
+	at       []int
+	taken    int
+}
+
+func (q *warningQueue) addWarning(index int, d *Diagnostic) {
+	q.Warnings = append(q.Warnings, d)
+	q.at = append(q.at, index)
+}
+
+// takeWarnings returns the warnings found before the token at index that
+// were not taken yet.
+func (q *warningQueue) takeWarnings(index int) DiagnosticList {
+	from := q.taken
+
+	for q.taken < len(q.Warnings) && q.at[q.taken] <= index {
+		q.taken++
+	}
+
+	return q.Warnings[from:q.taken]
+}
+
+// expectation is the furthest point a parse failed to get past, and what
+// the parser expected to find there.
+type expectation struct {
+	index    int
+	token    *Token
+	expected []string
+}
+
+// add records that what was expected at index, unless the parse already got
+// further.
+func (e *expectation) add(index int, token *Token, what string) {
+	if e.token != nil && index < e.index {
+		return
+	} else if e.token == nil || index > e.index {
+		*e = expectation{index, token, nil}
+	}
+
+	for _, expected := range e.expected {
+		if expected == what {
+			return
+		}
+	}
+
+	e.expected = append(e.expected, what)
+}
+
+// message describes the expectation as "expected X or Y, found Z".
+func (e *expectation) message() string {
+	expected := e.expected[len(e.expected)-1]
+
+	if len(e.expected) > 1 {
+		expected = strings.Join(e.expected[:len(e.expected)-1], ", ") + " or " + expected
+	}
+
+	return fmt.Sprintf("expected %s, found %s", expected, describeToken(e.token))
+}
+
+func describeToken(token *Token) string {
+	if token.Type == TOK_EOF {
+		return "end of input"
+	}
+
+	return "'" + token.TokenString + "'"
+}
@@ -0,0 +1,230 @@
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Edit replaces Length bytes of the source at Offset with Text.
+type Edit struct {
+	Offset int
+	Length int
+	Text   string
+}
+
+// lexState is the state of the lexer at the start of the gap before a token,
+// right after the previous one. A token never ends inside a comment or a
+// literal, so the lexer is always scanning code there and can be restarted
+// from the gap with nothing more than whether a directive may begin, which
+// it only may before the first token. The state is not stored with the
+// tokens, as it follows from where the previous one ends.
+type lexState struct {
+	Offset      int
+	AtLineStart bool
+}
+
+// lexSource is the text a TokenSet was lexed from without preprocessing,
+// along with the lexer settings needed to lex it again. bom tells whether a
+// byte order mark preceded text, as leading trivia of the first token.
+type lexSource struct {
+	text               string
+	bom                bool
+	keepTrivia         bool
+	warnNestedComment  bool
+	unicodeIdentifiers bool
+}
+
+// gapBefore returns the state of the lexer in the gap before token i.
+func (t *TokenSet) gapBefore(i int) lexState {
+	if i == 0 {
+		return lexState{Offset: 0, AtLineStart: true}
+	}
+
+	return lexState{Offset: t.offset(t.Tokens[i-1].End)}
+}
+
+// offset returns the offset of p in the source, which is the only file of
+// tokens that can be relexed.
+func (t *TokenSet) offset(p Pos) int {
+	return t.FileSet.files[0].Offset(p)
+}
+
+// Source returns the text the tokens were lexed from, including any edits
+// and after any byte order mark, or "" if it was the output of the
+// preprocessor. Token positions and edits are offsets into it.
+func (t *TokenSet) Source() string {
+	if t.source == nil {
+		return ""
+	}
+
+	return t.source.text
+}
+
+// Relex applies edit to the source of the tokens and lexes only the part it
+// affects again. Scanning restarts in the last gap between tokens that
+// starts before the edit, unless the lexer may have looked into the edit
+// when scanning the token before the gap: one ending right at the edit may run
+// on into the new text, and one starting just before it may be the "." of a
+// "..." now. It stops at the first token after the edit whose gap starts
+// where an old one did in the same state: from there on the text and so the
+// tokens are the same as before, and they are kept with their positions
+// shifted. The result is what lexing the edited source afresh would give.
+// The new tokens go into Tokens in place where they fit, so a slice of the
+// tokens taken before the edit does not keep the old ones.
+//
+// Only tokens lexed without preprocessing, by NewLexer or by Lex with
+// Options.KeepTrivia, can be relexed. Lexical errors in the new text become
+// error tokens as usual.
+func (t *TokenSet) Relex(edit Edit) error {
+	if t.source == nil {
+		return errors.New("relex: tokens were lexed from preprocessed source")
+	}
+
+	src := t.source.text
+
+	if edit.Offset < 0 || edit.Length < 0 || edit.Offset+edit.Length > len(src) {
+		return fmt.Errorf("relex: edit of %d bytes at %d is outside the source of %d bytes", edit.Length, edit.Offset, len(src))
+	}
+
+	removed := src[edit.Offset : edit.Offset+edit.Length]
+	text := src[:edit.Offset] + edit.Text + src[edit.Offset+edit.Length:]
+	delta := len(edit.Text) - len(removed)
+	editEnd := edit.Offset + len(edit.Text)
+
+	old := t.Tokens
+	restart := sort.Search(len(old), func(i int) bool { return t.gapBefore(i).Offset >= edit.Offset }) - 1
+
+	for restart > 0 && t.offset(old[restart-1].Pos)+maxOperatorLength > edit.Offset {
+		restart--
+	}
+
+	if restart < 0 {
+		restart = 0
+	}
+
+	source := *t.source
+	source.text = text
+
+	l := NewLexer(text)
+	l.file.name = t.FileSet.files[0].name
+	l.tokens.source = &source
+	l.keepTrivia = source.keepTrivia
+	l.warnNestedComment = source.warnNestedComment
+	l.unicodeIdentifiers = source.unicodeIdentifiers
+
+	if restart < len(old) {
+		l.gap = t.gapBefore(restart)
+	}
+
+	if l.keepTrivia && restart == 0 && source.bom {
+		l.pending = []Trivia{{Trivia_bom, utf8BOM}}
+	}
+
+	// the trailing trivia of the token before the gap lies in it, so the
+	// lexer starts from that token to collect it again
+	first := 0
+
+	if l.keepTrivia && restart > 0 {
+		first = 1
+		last := tokenTrivia{leading: t.trivia[restart-1].leading}
+
+		if old[restart-1].Type == TOK_ERROR {
+			last.trailing = t.trivia[restart-1].trailing[:1:1]
+		}
+
+		l.tokens.Tokens = []*Token{old[restart-1]}
+		l.tokens.trivia = []tokenTrivia{last}
+	}
+
+	l.start, l.pos = l.gap.Offset, l.gap.Offset
+	l.atLineStart = l.gap.AtLineStart
+
+	next := restart
+
+	l.resync = func(gap lexState) bool {
+		if gap.Offset < editEnd {
+			return false
+		}
+
+		oldGap := t.gapBefore(next)
+
+		for next < len(old) && oldGap.Offset+delta < gap.Offset {
+			next++
+			oldGap = t.gapBefore(next)
+		}
+
+		return next < len(old) && oldGap.Offset+delta == gap.Offset && oldGap.AtLineStart == gap.AtLineStart
+	}
+
+	l.run()
+
+	// the new tokens replace those up to the one the lexer stopped at
+	end := len(old)
+
+	if l.stopped {
+		end = next
+
+		for _, token := range old[next:] {
+			token.Pos += Pos(delta)
+			token.End += Pos(delta)
+		}
+	}
+
+	t.Tokens = spliceTokens(old, restart, end, l.tokens.Tokens[first:])
+
+	if l.keepTrivia {
+		if first > 0 {
+			t.trivia[restart-1] = l.tokens.trivia[0]
+		}
+
+		t.trivia = spliceTrivia(t.trivia, restart, end, l.tokens.trivia[first:])
+	}
+
+	t.CurIndex = 0
+	t.FileSet = l.tokens.FileSet
+	t.source = l.tokens.source
+
+	return nil
+}
+
+// spliceTokens replaces tokens[from:to] with replacement, in place if
+// there is room.
+func spliceTokens(tokens []*Token, from int, to int, replacement []*Token) []*Token {
+	size := len(tokens) - (to - from) + len(replacement)
+
+	if size > cap(tokens) {
+		spliced := make([]*Token, size)
+		copy(spliced, tokens[:from])
+		copy(spliced[from+len(replacement):], tokens[to:])
+		tokens = spliced
+	} else {
+		tail := tokens[to:]
+		tokens = tokens[:size]
+		copy(tokens[from+len(replacement):], tail)
+	}
+
+	copy(tokens[from:], replacement)
+
+	return tokens
+}
+
+// spliceTrivia is spliceTokens for the trivia of the tokens.
+func spliceTrivia(trivia []tokenTrivia, from int, to int, replacement []tokenTrivia) []tokenTrivia {
+	size := len(trivia) - (to - from) + len(replacement)
+
+	if size > cap(trivia) {
+		spliced := make([]tokenTrivia, size)
+		copy(spliced, trivia[:from])
+		copy(spliced[from+len(replacement):], trivia[to:])
+		trivia = spliced
+	} else {
+		tail := trivia[to:]
+		trivia = trivia[:size]
+		copy(trivia[from+len(replacement):], tail)
+	}
+
+	copy(trivia[from:], replacement)
+
+	return trivia
+}
@@ -0,0 +1,115 @@
+package frontend
+
+import (
+	"github.com/coocood/assrt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var relexSource = "#include <x.h>\n#define A \\\n  1\n/* doc */\nint f(int a, char *s);\n\n" +
+	"int main(void) { // entry\n\tint x = 12 + a; /* a\n b */ f(x, \"s\\n\");\n\treturn x...;\n}\n"
+
+var relexFragments = []string{"", " ", "\n", "\r", "\r\n", "\xff", "é", "/*", "*/", "//", "\"", "#", "\\\n", "x", "1", "int", "...", ".", "@", "(", "\t"}
+
+func lexForRelex(src string, keepTrivia bool) *TokenSet {
+	l := NewLexer(src)
+	l.file.name = "t.xxx"
+	l.keepTrivia = keepTrivia
+	l.tokens.source.keepTrivia = keepTrivia
+	l.run()
+
+	return l.tokens
+}
+
+func TestRelex(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	for _, keepTrivia := range []bool{false, true} {
+		random := rand.New(rand.NewSource(1))
+		tokens := lexForRelex(relexSource, keepTrivia)
+
+		for i := 0; i < 2000; i++ {
+			src := tokens.Source()
+			offset := random.Intn(len(src) + 1)
+			length := random.Intn(4)
+
+			if offset+length > len(src) {
+				length = len(src) - offset
+			}
+
+			edit := Edit{offset, length, relexFragments[random.Intn(len(relexFragments))]}
+			assert.MustNil(tokens.Relex(edit))
+
+			expected := lexForRelex(src[:offset]+edit.Text+src[offset+length:], keepTrivia)
+			assert.MustEqual(expected.Source(), tokens.Source())
+			assert.MustEqual(len(expected.Tokens), len(tokens.Tokens))
+
+			for j, token := range tokens.Tokens {
+				assert.MustEqual(*expected.Tokens[j], *token)
+				assert.MustEqual(expected.Leading(j), tokens.Leading(j))
+				assert.MustEqual(expected.Trailing(j), tokens.Trailing(j))
+			}
+		}
+	}
+
+	// an edit inside the body leaves the tokens around it alone, although the
+	// one right before it collects its trailing trivia again
+	tokens := lexForRelex(relexSource, true)
+	before := append([]*Token(nil), tokens.Tokens...)
+	end := before[len(before)-1].Pos
+
+	assert.MustNil(tokens.Relex(Edit{Offset: len("#include <x.h>\n#define A \\\n  1\n/* doc */\nint f(int a, char *s);\n\nint main(void) { // entry\n\tint x"), Text: "yz"}))
+	assert.Equal("xyz", tokens.Tokens[18].TokenString)
+	assert.True(before[16] == tokens.Tokens[16])
+	assert.True(before[19] == tokens.Tokens[19])
+	assert.Equal(end+2, tokens.Tokens[len(tokens.Tokens)-1].Pos)
+
+	// opening a comment swallows the directives up to the next "*/"
+	assert.MustNil(tokens.Relex(Edit{Offset: 0, Text: "/*"}))
+	assert.Equal([]Trivia{{Trivia_comment, "/*#include <x.h>\n#define A \\\n  1\n/* doc */"}, {Trivia_newline, "\n"}}, tokens.Leading(0))
+
+	assert.NotNil(tokens.Relex(Edit{Offset: len(tokens.Source()), Length: 1}))
+
+	// a byte order mark stays in front of the first token, outside the
+	// source the edits apply to
+	tokens, err := LexString("t.xxx", "\xef\xbb\xbfint a;\n", &Options{KeepTrivia: true})
+	assert.MustNil(err)
+	assert.Equal("int a;\n", tokens.Source())
+	assert.MustNil(tokens.Relex(Edit{Offset: 0, Length: 3, Text: "char"}))
+
+	text := ""
+
+	for i := range tokens.Tokens {
+		text += tokens.FullText(i)
+	}
+
+	assert.Equal("\xef\xbb\xbfchar a;\n", text)
+	assert.Equal(1, tokens.Position(tokens.Tokens[0]).Column)
+
+	preprocessed, err := LexString("t.xxx", "int a;", &Options{})
+	assert.MustNil(err)
+	assert.NotNil(preprocessed.Relex(Edit{Offset: 0, Text: " "}))
+}
+
+// BenchmarkRelex types a character into a function in the middle of a long
+// source and deletes it again.
+func BenchmarkRelex(b *testing.B) {
+	src := generateSource(5000)
+	tokens := lexForRelex(src, true)
+	offset := len(src)/2 + strings.Index(src[len(src)/2:], "return")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		edit := Edit{Offset: offset, Text: "x"}
+
+		if i%2 == 1 {
+			edit = Edit{Offset: offset, Length: 1}
+		}
+
+		if err := tokens.Relex(edit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,18 +2,72 @@
 package frontend
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
 type Lexer struct {
-	input   string
-	start   int
-	pos     int
-	width   int
-	lineNum int
-	tokens  *TokenSet
+	input string
+	start int
+	pos   int
+	width int
+
+	// pp supplies the input a few lines at a time when it is preprocessed,
+	// with the origin of each line in lineMap from line lineBase+1 on. Its
+	// warnings up to warned have been passed on, each once the lexer reaches
+	// the line it was reported before, and err is the error it failed with.
+	pp       *Preprocessor
+	lineMap  []SourceLine
+	lineBase int
+	warned   int
+	err      error
+
+	// lineNum is the input line being scanned and lineStart the offset it
+	// starts at
+	lineNum   int
+	lineStart int
+
+	file   *File
+	tokens *TokenSet
+
+	// items receives the tokens and warnings instead of tokens when lexing
+	// concurrently, until done is closed
+	items   chan lexItem
+	done    chan struct{}
+	stopped bool
+
+	// keepTrivia records trivia in the side table of tokens, with pending
+	// the trivia leading the next token. lineEnded tells whether a line
+	// break has been skipped since the last token.
+	keepTrivia  bool
+	pending     []Trivia
+	lineEnded   bool
+	atLineStart bool
+
+	// warnNestedComment reports "/*" inside a block comment
+	warnNestedComment bool
+
+	// unicodeIdentifiers allows non-ASCII letters in identifiers. invalid is
+	// the offset of the first byte since the last token or trivia that is
+	// not valid UTF-8, or -1.
+	unicodeIdentifiers bool
+	invalid            int
+
+	// gap is the state after the last token, where the gap before the next
+	// one starts. resync lets Relex stop the scan before the next token.
+	gap    lexState
+	resync func(gap lexState) bool
+
+	// words interns identifiers and constants, and slab is where the next
+	// tokens are allocated
+	words map[string]word
+	slab  []Token
 }
 
 type StateFn func(*Lexer) StateFn
@@ -21,49 +75,366 @@ type StateFn func(*Lexer) StateFn
 const (
 	leftComment  string = "/*"
 	rightComment string = "*/"
-	idInt        string = "int"
-	idReturn     string = "return"
+	lineComment  string = "//"
 	eof          rune   = rune(0)
 )
 
+// Character classes of input bytes. The bytes of multi-byte UTF-8 sequences
+// belong to none, so the byte-at-a-time scanning below only ever matches
+// ASCII and anything else goes through next.
+const (
+	classIdentStart uint8 = 1 << iota
+	classDigit
+	classSpace
+
+	classIdentChar = classIdentStart | classDigit
+)
+
+var charClass = func() (table [256]uint8) {
+	for c := 'a'; c <= 'z'; c++ {
+		table[c] |= classIdentStart
+		table[c-'a'+'A'] |= classIdentStart
+	}
+
+	for c := '0'; c <= '9'; c++ {
+		table[c] |= classDigit
+	}
+
+	table['_'] |= classIdentStart
+
+	for _, c := range " \t\v\f" {
+		table[c] |= classSpace
+	}
+
+	return
+}()
+
+// tokenSlabSize is how many tokens the lexer allocates at once.
+const tokenSlabSize = 256
+
+// word is an interned identifier or constant. Every token of the same text
+// shares one copy of it, which does not keep the input alive.
+type word struct {
+	text string
+	kind TokenType
+}
+
+// NewLexer returns a lexer for input, which is registered as an unnamed file
+// in the FileSet of the resulting tokens.
 func NewLexer(input string) *Lexer {
-	return &Lexer{input: input, tokens: NewTokenSet()}
+	tokens := NewTokenSet()
+	file := tokens.FileSet.AddFile("", len(input))
+	file.setContent(input)
+
+	tokens.source = &lexSource{text: input}
+
+	return &Lexer{input: input, lineNum: 1, file: file, tokens: tokens, atLineStart: true,
+		gap: lexState{Offset: 0, AtLineStart: true}, words: make(map[string]word), invalid: -1}
 }
 
 func (l *Lexer) next() (r rune) {
-	if l.pos >= len(l.input) {
+	if l.pos >= len(l.input) || l.stopped {
 		l.width = 0
 		return eof
 	}
 
+	if c := l.input[l.pos]; c < utf8.RuneSelf {
+		l.width = 1
+		l.pos++
+		return rune(c)
+	}
+
 	r, l.width = utf8.DecodeRuneInString(l.input[l.pos:])
+
+	if r == utf8.RuneError && l.width == 1 && l.invalid < 0 {
+		l.invalid = l.pos
+	}
+
 	l.pos += l.width
 
 	return r
 }
 
+// span returns the source file and positions of the input bytes
+// start..end, which begin on input line lineNum starting at lineStart.
+// Without a line map the input is the source.
+func (l *Lexer) span(start int, end int, lineNum int, lineStart int) (*File, Pos, Pos) {
+	if len(l.lineMap) == 0 {
+		return l.file, l.file.Pos(start), l.file.Pos(end)
+	}
+
+	source := l.lineMap[len(l.lineMap)-1]
+
+	if i := lineNum - 1 - l.lineBase; i < len(l.lineMap) {
+		source = l.lineMap[i]
+	}
+
+	offset, endOffset := source.sourceSpan(start-lineStart, end-start)
+
+	return source.file, source.file.Pos(offset), source.file.Pos(endOffset)
+}
+
+// newToken is NewToken for the text at start..end, allocated from the slab
+// and located in the source.
+func (l *Lexer) newToken(str string, t TokenType, start int, end int, lineNum int, lineStart int) *Token {
+	if len(l.slab) == 0 {
+		l.slab = make([]Token, tokenSlabSize)
+	}
+
+	token := &l.slab[0]
+	l.slab = l.slab[1:]
+
+	token.Type, token.TokenString, token.Number = t, str, 0x7fffffff
+
+	if t == TOK_DIGIT {
+		token.Number, _ = strconv.Atoi(str)
+	}
+
+	_, token.Pos, token.End = l.span(start, end, lineNum, lineStart)
+
+	return token
+}
+
+// word returns the interned copy of text and its kind.
+func (l *Lexer) word(text string) word {
+	w, ok := l.words[text]
+
+	if !ok {
+		w = word{string([]byte(text)), LookupKeyword(text)}
+		l.words[w.text] = w
+	}
+
+	return w
+}
+
+// push sends token on, along with the trivia leading it, and reports
+// whether it was sent.
+func (l *Lexer) push(token *Token) bool {
+	if l.stopped {
+		return false
+	}
+
+	if l.resync != nil && l.resync(l.gap) {
+		l.stopped = true
+		return false
+	}
+
+	l.gap = lexState{Offset: l.pos}
+	l.atLineStart = false
+
+	if l.keepsTrivia() {
+		l.tokens.trivia = append(l.tokens.trivia, tokenTrivia{leading: l.pending})
+		l.pending = nil
+		l.lineEnded = false
+	}
+
+	l.send(token)
+
+	return !l.stopped
+}
+
+// keepsTrivia tells whether trivia is recorded, which it only is in a
+// TokenSet.
+func (l *Lexer) keepsTrivia() bool {
+	return l.keepTrivia && l.items == nil
+}
+
+func (l *Lexer) send(token *Token) {
+	if l.items == nil {
+		l.tokens.Tokens = append(l.tokens.Tokens, token)
+		return
+	}
+
+	l.sendItem(lexItem{token: token})
+}
+
+// sendItem sends item to the TokenStream. Once the consumer gives up, the
+// scan runs straight to the end.
+func (l *Lexer) sendItem(item lexItem) {
+	select {
+	case l.items <- item:
+	case <-l.done:
+		l.stopped = true
+	}
+}
+
+// warn reports a warning found before the next token.
+func (l *Lexer) warn(warning *Diagnostic) {
+	if l.items != nil {
+		l.sendItem(lexItem{diagnostic: warning})
+	} else {
+		l.tokens.addWarning(len(l.tokens.Tokens), warning)
+	}
+}
+
+// emit emits the text scanned since the last token as a token of kind t,
+// spelled as the operator or keyword t if it is one, or else interned.
 func (l *Lexer) emit(t TokenType) {
-	l.tokens.Tokens = append(l.tokens.Tokens, NewToken(l.input[l.start:l.pos], t, l.lineNum))
+	text := l.input[l.start:l.pos]
+
+	if spelling := tokenSpellings[t]; spelling != "" {
+		text = spelling
+	} else if t != TOK_EOF {
+		text = l.word(text).text
+	}
+
+	l.emitText(t, text)
+}
+
+// emitText emits the text scanned since the last token as a token of kind t
+// spelled text.
+func (l *Lexer) emitText(t TokenType, text string) {
+	l.push(l.newToken(text, t, l.start, l.pos, l.lineNum, l.lineStart))
+	l.start = l.pos
+	l.invalid = -1
+}
+
+// emitError emits an error token carrying the message in place of the text
+// scanned since the last token, which it spans.
+func (l *Lexer) emitError(format string, args ...interface{}) {
+	l.emitErrorAt(l.start, format, args...)
+}
+
+// emitErrorAt is emitError for an error at offset within the text, where the
+// token is placed; it still ends where the text does.
+func (l *Lexer) emitErrorAt(offset int, format string, args ...interface{}) {
+	lineNum, lineStart := l.lineNum, l.lineStart
+
+	// an error in a comment may lie on an earlier line
+	if offset < lineStart {
+		lineNum -= countLineBreaks(l.input[offset:lineStart])
+		lineStart = strings.LastIndexAny(l.input[:offset], "\n\r") + 1
+	}
+
+	token := l.newToken(fmt.Sprintf(format, args...), TOK_ERROR, offset, l.pos, lineNum, lineStart)
+
+	if l.push(token) && l.keepsTrivia() {
+		entry := &l.tokens.trivia[len(l.tokens.trivia)-1]
+		entry.trailing = []Trivia{{Trivia_skipped, l.input[l.start:l.pos]}}
+	}
+
 	l.start = l.pos
+	l.invalid = -1
 }
 
-func (l *Lexer) accept(str string) bool {
-	if strings.IndexRune(str, l.next()) >= 0 {
+// errorf emits an error token like emitError and ends the scan, with the
+// EOF token every scan ends with.
+func (l *Lexer) errorf(format string, args ...interface{}) StateFn {
+	l.emitError(format, args...)
+	l.emit(TOK_EOF)
+
+	return nil
+}
+
+// warnf reports a warning at the current position, before the next token.
+func (l *Lexer) warnf(format string, args ...interface{}) {
+	_, pos, _ := l.span(l.pos, l.pos, l.lineNum, l.lineStart)
+	l.warn(&Diagnostic{l.tokens.FileSet.Position(pos), Severity_warning, fmt.Sprintf(format, args...)})
+}
+
+// refill reads more preprocessed input once the input has been scanned,
+// keeping the text scanned since the last token, and reports whether there
+// was more. Offsets into the input move with it.
+func (l *Lexer) refill() bool {
+	if l.pp == nil || l.stopped {
+		return false
+	}
+
+	text, lines, err := l.pp.read()
+
+	if err != nil {
+		l.err = err
+
+		if l.items != nil {
+			l.sendItem(lexItem{diagnostic: asDiagnostic(err)})
+		}
+	}
+
+	if len(lines) == 0 {
+		l.passWarnings(len(l.pp.Warnings))
+		l.pp = nil
+		return false
+	}
+
+	// the lines before the one the text kept starts on are done with
+	line := l.lineNum
+
+	if l.start < l.lineStart {
+		line -= countLineBreaks(l.input[l.start:l.lineStart])
+	}
+
+	if done := line - 1 - l.lineBase; done < len(l.lineMap) {
+		l.lineMap, l.lineBase = l.lineMap[done:], line-1
+	}
+
+	l.lineMap = append(l.lineMap, lines...)
+
+	drop := l.start
+
+	if drop == len(l.input) {
+		l.input = text
+	} else {
+		l.input = l.input[drop:] + text
+	}
+
+	l.start, l.pos, l.lineStart = 0, l.pos-drop, l.lineStart-drop
+
+	if l.invalid >= 0 {
+		l.invalid -= drop
+	}
+
+	l.passLineWarnings()
+
+	// only the first line may be empty
+	return l.pos < len(l.input) || l.refill()
+}
+
+// passLineWarnings passes on the warnings of the preprocessor reported
+// before the current line was output.
+func (l *Lexer) passLineWarnings() {
+	n := l.warned
+
+	for n < len(l.pp.warningLines) && l.pp.warningLines[n] < l.lineNum {
+		n++
+	}
+
+	l.passWarnings(n)
+}
+
+// passWarnings passes on the warnings of the preprocessor up to n.
+func (l *Lexer) passWarnings(n int) {
+	for ; l.warned < n; l.warned++ {
+		l.warn(l.pp.Warnings[l.warned])
+	}
+}
+
+// newLine moves on to the next input line, which starts at the current
+// position.
+func (l *Lexer) newLine() {
+	l.lineNum++
+	l.lineStart = l.pos
+
+	if l.pp != nil && l.warned < len(l.pp.Warnings) {
+		l.passLineWarnings()
+	}
+}
+
+func (l *Lexer) acceptClass(class uint8) bool {
+	if l.pos < len(l.input) && !l.stopped && charClass[l.input[l.pos]]&class != 0 {
+		l.pos++
 		return true
 	}
 
-	l.backup()
 	return false
 }
 
-func (l *Lexer) acceptRun(str string) {
-	for strings.IndexRune(str, l.next()) >= 0 {
+func (l *Lexer) acceptClassRun(class uint8) {
+	for l.acceptClass(class) {
 	}
-	l.backup()
 }
 
 func (l *Lexer) acceptPrefix(prefix string) bool {
-	if strings.HasPrefix(l.input[l.pos:], prefix) {
+	if !l.stopped && strings.HasPrefix(l.input[l.pos:], prefix) {
 		l.pos += len(prefix)
 		return true
 	}
@@ -71,11 +442,57 @@ func (l *Lexer) acceptPrefix(prefix string) bool {
 	return false
 }
 
+// acceptLineBreak accepts a "\n", "\r\n" or lone "\r" line break.
+func (l *Lexer) acceptLineBreak() bool {
+	return l.acceptPrefix("\r\n") || l.acceptPrefix("\n") || l.acceptPrefix("\r")
+}
+
+// atUnicodeLetter tells whether the input continues with a letter that may
+// start an identifier with unicodeIdentifiers, other than an ASCII one.
+func (l *Lexer) atUnicodeLetter() bool {
+	if !l.unicodeIdentifiers || l.stopped {
+		return false
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.input[l.pos:])
+
+	return r >= utf8.RuneSelf && unicode.IsLetter(r)
+}
+
 func (l *Lexer) backup() {
 	l.pos -= l.width
 }
 
-func (l *Lexer) ignore() {
+// skip passes over the text scanned since the last token. With keepTrivia
+// it becomes trailing trivia of the previous token up to the end of that
+// token's line, and leading trivia of the next token after it. A comment or
+// directive that is not valid UTF-8 is rejected as a whole instead.
+func (l *Lexer) skip(kind TriviaKind) {
+	if l.invalid >= 0 {
+		what := "comment"
+
+		if kind == Trivia_directive {
+			what = "preprocessing directive"
+		}
+
+		l.emitErrorAt(l.invalid, "invalid UTF-8 encoding in %s", what)
+		return
+	}
+
+	if l.keepsTrivia() {
+		trivia := Trivia{kind, l.input[l.start:l.pos]}
+
+		if kind == Trivia_newline {
+			l.lineEnded = true
+		}
+
+		if n := len(l.tokens.trivia); n > 0 && !l.lineEnded {
+			l.tokens.trivia[n-1].trailing = append(l.tokens.trivia[n-1].trailing, trivia)
+		} else {
+			l.pending = append(l.pending, trivia)
+		}
+	}
+
 	l.start = l.pos
 }
 
@@ -83,69 +500,366 @@ func (l *Lexer) run() {
 	for state := lexCode; state != nil; {
 		state = state(l)
 	}
+
+	if l.items != nil {
+		close(l.items)
+	}
 }
 
 func lexCode(l *Lexer) StateFn {
-	for {
-		if l.acceptPrefix(leftComment) {
+	for !l.stopped && (l.pos < len(l.input) || l.refill()) {
+		c := l.input[l.pos]
+
+		switch class := charClass[c]; {
+		case class&classIdentStart != 0 || c >= utf8.RuneSelf && l.atUnicodeLetter():
+			lexIdentifier(l)
+		case class&classSpace != 0:
+			l.acceptClassRun(classSpace)
+			l.skip(Trivia_space)
+		case c == '\n' || c == '\r':
+			l.acceptLineBreak()
+			l.newLine()
+			l.atLineStart = true
+			l.skip(Trivia_newline)
+		case class&classDigit != 0:
+			lexNumber(l)
+		case c == '"':
+			l.pos++
+			return lexString
+		case c == '/' && l.acceptPrefix(leftComment):
 			return lexComment
+		case c == '/' && l.acceptPrefix(lineComment):
+			return lexLineComment
+		case c == '#' && l.keepTrivia && l.atLineStart:
+			l.pos++
+			lexDirective(l)
+		default:
+			if tokenType, length := LookupOperator(l.input[l.pos:]); length > 0 {
+				l.pos += length
+				l.emit(tokenType)
+			} else if r := l.next(); l.invalid >= 0 {
+				l.emitError("invalid UTF-8 encoding")
+			} else {
+				l.emitError("invalid character %q", r)
+			}
 		}
+	}
 
-		if l.acceptPrefix(idInt) {
-			l.emit(TOK_INT)
-		} else if l.acceptPrefix(idReturn) {
-			l.emit(TOK_RETURN)
-		} else if l.accept("abcdefghijklnmopqrstuvwxyz") {
-			l.acceptRun("abcdefghijklnmopqrstuvwxyz0123456789")
-			l.emit(TOK_IDENTIFIER)
-		} else if l.accept("\n") {
-			l.lineNum += 1
-			l.ignore()
-		} else if l.accept("0123456789") {
-			l.acceptRun("0123456789")
-			l.emit(TOK_DIGIT)
-		} else if l.accept("*+-=;,(){}") {
-			l.emit(TOK_SYMBOL)
-		} else {
-			l.next()
-			l.ignore()
+	l.emit(TOK_EOF)
+
+	return nil
+}
+
+func lexComment(l *Lexer) StateFn {
+	for {
+		if l.acceptPrefix(rightComment) {
+			l.skip(Trivia_comment)
+			return lexCode
+		}
+
+		if l.warnNestedComment && strings.HasPrefix(l.input[l.pos:], leftComment) {
+			l.warnf("\"/*\" within comment")
 		}
 
-		if l.next() == eof {
-			l.emit(TOK_EOF)
+		if r := l.next(); r == eof && l.refill() {
+			continue
+		} else if r == eof {
+			return l.errorf("unterminated comment")
+		} else if r == '\n' || r == '\r' && !strings.HasPrefix(l.input[l.pos:], "\n") {
+			l.newLine()
+		}
+	}
+}
+
+// lexLineComment skips a "//" comment, leaving the line break to lexCode.
+func lexLineComment(l *Lexer) StateFn {
+	for {
+		if r := l.next(); r == '\n' || r == '\r' {
+			l.backup()
 			break
-		} else {
+		} else if r == eof {
+			break
+		}
+	}
+
+	l.skip(Trivia_comment)
+	return lexCode
+}
+
+// lexDirective skips a preprocessing directive, including its continuation
+// lines, when lexing without preprocessing.
+func lexDirective(l *Lexer) {
+	for {
+		r := l.next()
+
+		if r == '\\' && l.acceptLineBreak() {
+			l.newLine()
+		} else if r == '\n' || r == '\r' {
 			l.backup()
+			break
+		} else if r == eof {
+			break
 		}
 	}
 
-	return nil
+	l.skip(Trivia_directive)
 }
 
-func lexComment(l *Lexer) StateFn {
+// lexString scans a string literal up to the closing quote or the end of
+// the line; an unterminated literal is left for the parser to reject.
+func lexString(l *Lexer) StateFn {
 	for {
-		if l.acceptPrefix(rightComment) {
-			l.ignore()
+		switch l.next() {
+		case '\\':
+			if r := l.next(); r == '\n' || r == '\r' || r == eof {
+				l.backup()
+			}
+		case '"':
+			if l.invalid >= 0 {
+				l.emitErrorAt(l.invalid, "invalid UTF-8 encoding in string literal")
+			} else if _, ok := unquoteString(l.input[l.start:l.pos]); !ok {
+				l.emitError("invalid escape sequence in string literal %s", l.input[l.start:l.pos])
+			} else {
+				l.emit(TOK_STRING)
+			}
+
 			return lexCode
+		case '\n', '\r':
+			l.backup()
+			l.emitError("missing terminating \" character")
+			return lexCode
+		case eof:
+			l.emitError("missing terminating \" character")
+			return lexCode
+		}
+	}
+}
+
+// lexIdentifier scans a word, so that "integer" is not "int" "eger", and
+// emits it as a keyword or identifier.
+func lexIdentifier(l *Lexer) {
+	for {
+		l.acceptClassRun(classIdentChar)
+
+		if !l.unicodeIdentifiers || l.pos >= len(l.input) || l.input[l.pos] < utf8.RuneSelf {
+			break
 		}
 
-		if l.next() == eof {
+		r, width := utf8.DecodeRuneInString(l.input[l.pos:])
+
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
 			break
 		}
+
+		l.pos += width
+	}
+
+	w := l.word(l.input[l.start:l.pos])
+	l.emitText(w.kind, w.text)
+}
+
+// lexNumber scans the rest of a decimal constant. Letters or digits running
+// on from it, as in "0x1f" or "12abc", make the whole word malformed.
+func lexNumber(l *Lexer) {
+	l.acceptClassRun(classDigit)
+
+	if l.acceptClass(classIdentChar) {
+		l.acceptClassRun(classIdentChar)
+		l.emitError("invalid integer constant %s", l.input[l.start:l.pos])
+	} else if _, err := strconv.ParseInt(l.input[l.start:l.pos], 10, 32); err != nil {
+		l.emitError("integer constant %s is too large", l.input[l.start:l.pos])
+	} else {
+		l.emit(TOK_DIGIT)
+	}
+}
+
+// unquoteString returns the value of a C string literal.
+func unquoteString(literal string) (string, bool) {
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return "", false
+	}
+
+	var value []byte
+
+	s := literal[1 : len(literal)-1]
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			value = append(value, s[i])
+			continue
+		}
+
+		if i++; i >= len(s) {
+			return "", false
+		}
+
+		switch s[i] {
+		case 'n':
+			value = append(value, '\n')
+		case 't':
+			value = append(value, '\t')
+		case 'r':
+			value = append(value, '\r')
+		case 'a':
+			value = append(value, '\a')
+		case 'b':
+			value = append(value, '\b')
+		case 'f':
+			value = append(value, '\f')
+		case 'v':
+			value = append(value, '\v')
+		case '\\', '\'', '"', '?':
+			value = append(value, s[i])
+		case 'x':
+			n, digits := 0, 0
+
+			for ; i+1 < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[i+1]) >= 0; i++ {
+				n = n*16 + strings.IndexByte("0123456789abcdef", s[i+1]|0x20)
+				digits++
+			}
+
+			if digits == 0 {
+				return "", false
+			}
+
+			value = append(value, byte(n))
+		default:
+			if s[i] < '0' || s[i] > '7' {
+				return "", false
+			}
+
+			n := int(s[i] - '0')
+
+			for digits := 1; digits < 3 && i+1 < len(s) && '0' <= s[i+1] && s[i+1] <= '7'; digits++ {
+				i++
+				n = n*8 + int(s[i]-'0')
+			}
+
+			value = append(value, byte(n))
+		}
 	}
 
-	return nil
+	return string(value), true
 }
 
 func LexicalAnalysis(filename string) *TokenSet {
-	input, err := ioutil.ReadFile(filename)
+	return LexicalAnalysisWithOptions(filename, &Options{})
+}
+
+// LexicalAnalysisWithOptions preprocesses filename and returns its tokens, or
+// nil after reporting preprocessing or lexical errors on stderr.
+func LexicalAnalysisWithOptions(filename string, opts *Options) *TokenSet {
+	file, err := os.Open(filename)
 
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+
+	defer file.Close()
+
+	tokens, err := Lex(filename, file, opts)
+
+	if err != nil {
+		PrintError(os.Stderr, err)
+		return nil
+	}
+
+	return tokens
+}
+
+// Lex preprocesses the source read from r and returns its tokens. name is
+// used in positions and diagnostics. Lexical errors are returned as a
+// DiagnosticList, after the warnings; with opts.KeepTrivia the tokens, which
+// still cover the whole source, are returned along with them. Without errors
+// the warnings are left in the Warnings of the tokens.
+func Lex(name string, r io.Reader, opts *Options) (*TokenSet, error) {
+	opts = opts.orDefault()
+	lexer, err := newLexerFor(name, r, opts)
+
+	if err != nil {
+		return nil, err
 	}
 
-	lexer := NewLexer(string(input))
 	lexer.run()
 
-	return lexer.tokens
+	if lexer.err != nil {
+		return nil, lexer.err
+	}
+
+	var errs DiagnosticList
+
+	for _, token := range lexer.tokens.Tokens {
+		if token.Type == TOK_ERROR {
+			errs = append(errs, &Diagnostic{lexer.tokens.FileSet.Position(token.Pos), Severity_error, token.TokenString})
+		}
+	}
+
+	if len(errs) == 0 {
+		return lexer.tokens, nil
+	}
+
+	errs = append(append(DiagnosticList{}, lexer.tokens.Warnings...), errs...)
+
+	if opts.KeepTrivia {
+		return lexer.tokens, errs
+	}
+
+	return nil, errs
+}
+
+// newLexerFor returns a lexer for the source read from r, which is
+// preprocessed as the lexer reads it unless opts.KeepTrivia is set.
+func newLexerFor(name string, r io.Reader, opts *Options) (*Lexer, error) {
+	var lexer *Lexer
+
+	opts = opts.orDefault()
+
+	if opts.KeepTrivia {
+		input, err := ioutil.ReadAll(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		text := stripBOM(input)
+		lexer = NewLexer(string(text))
+		lexer.file.name = name
+		lexer.keepTrivia = true
+		lexer.tokens.source.keepTrivia = true
+
+		// positions start after the byte order mark, which leads the first
+		// token
+		if len(text) < len(input) {
+			lexer.pending = []Trivia{{Trivia_bom, utf8BOM}}
+			lexer.tokens.source.bom = true
+		}
+
+		lexer.tokens.source.warnNestedComment = opts.WarnNestedComment
+		lexer.tokens.source.unicodeIdentifiers = opts.UnicodeIdentifiers
+	} else {
+		input, err := ioutil.ReadAll(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pp := NewPreprocessor(opts)
+		pp.start(name, input)
+
+		lexer = NewLexer("")
+		lexer.pp = pp
+		lexer.tokens.FileSet = pp.FileSet()
+		lexer.tokens.source = nil
+	}
+
+	lexer.warnNestedComment = opts.WarnNestedComment
+	lexer.unicodeIdentifiers = opts.UnicodeIdentifiers
+
+	return lexer, nil
+}
+
+// LexString is Lex for source held in memory.
+func LexString(name string, src string, opts *Options) (*TokenSet, error) {
+	return Lex(name, strings.NewReader(src), opts)
 }
@@ -1,7 +1,11 @@
 package frontend
 
 import (
+	"fmt"
 	"github.com/coocood/assrt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -17,5 +21,400 @@ func TestLexicalAnalysis(t *testing.T) {
 	assert.Equal(10, tokens.Tokens[17].Number)
 	assert.Equal(TOK_DIGIT, tokens.Tokens[17].Type)
 	assert.Equal("}", tokens.Tokens[50].TokenString)
-	assert.Equal(TOK_SYMBOL, tokens.Tokens[50].Type)
+	assert.Equal(TOK_RBRACE, tokens.Tokens[50].Type)
+}
+
+func lexInput(input string) []*Token {
+	return lexInputSet(input).Tokens
+}
+
+func lexInputSet(input string) *TokenSet {
+	l := NewLexer(input)
+	l.run()
+
+	return l.tokens
+}
+
+func TestLexKeywordsAndIdentifiers(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokens := lexInput("integer returned int return chars constant void voids staticx extern")
+	expected := []struct {
+		str       string
+		tokenType TokenType
+	}{
+		{"integer", TOK_IDENTIFIER},
+		{"returned", TOK_IDENTIFIER},
+		{"int", TOK_INT},
+		{"return", TOK_RETURN},
+		{"chars", TOK_IDENTIFIER},
+		{"constant", TOK_IDENTIFIER},
+		{"void", TOK_VOID},
+		{"voids", TOK_IDENTIFIER},
+		{"staticx", TOK_IDENTIFIER},
+		{"extern", TOK_EXTERN},
+	}
+
+	assert.MustEqual(len(expected)+1, len(tokens))
+
+	for i, e := range expected {
+		assert.Equal(e.str, tokens[i].TokenString)
+		assert.Equal(e.tokenType, tokens[i].Type)
+	}
+
+	assert.Equal(TOK_EOF, tokens[len(expected)].Type)
+}
+
+func TestLexIdentifierSyntax(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokens := lexInput("_x Foo_Bar9 __int INT x1y2 9lives")
+
+	assert.MustEqual(7, len(tokens))
+	assert.Equal("_x", tokens[0].TokenString)
+	assert.Equal("Foo_Bar9", tokens[1].TokenString)
+	assert.Equal("__int", tokens[2].TokenString)
+	assert.Equal("INT", tokens[3].TokenString)
+	assert.Equal("x1y2", tokens[4].TokenString)
+
+	for _, token := range tokens[:5] {
+		assert.Equal(TOK_IDENTIFIER, token.Type)
+	}
+
+	// an identifier cannot start with a digit
+	assert.Equal(TOK_ERROR, tokens[5].Type)
+	assert.Equal("invalid integer constant 9lives", tokens[5].TokenString)
+}
+
+func TestLexOperators(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokens := lexInput("a=b/c,...(&f)[];{-*+}")
+	expected := []TokenType{
+		TOK_IDENTIFIER, TOK_ASSIGN, TOK_IDENTIFIER, TOK_SLASH, TOK_IDENTIFIER, TOK_COMMA, TOK_ELLIPSIS,
+		TOK_LPAREN, TOK_AMPERSAND, TOK_IDENTIFIER, TOK_RPAREN, TOK_LBRACKET, TOK_RBRACKET,
+		TOK_SEMICOLON, TOK_LBRACE, TOK_MINUS, TOK_STAR, TOK_PLUS, TOK_RBRACE, TOK_EOF}
+
+	assert.MustEqual(len(expected), len(tokens))
+
+	for i, tokenType := range expected {
+		assert.Equal(tokenType, tokens[i].Type)
+	}
+
+	assert.Equal("ELLIPSIS", TOK_ELLIPSIS.String())
+	assert.Equal("TokenType(-1)", TokenType(-1).String())
+}
+
+func TestLexComments(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokenSet := lexInputSet("a // b /* c\nd /* e\n// f */ g")
+	tokens := tokenSet.Tokens
+
+	assert.MustEqual(4, len(tokens))
+	assert.Equal("a", tokens[0].TokenString)
+	assert.Equal("d", tokens[1].TokenString)
+	assert.Equal(2, tokenSet.Position(tokens[1]).Line)
+	assert.Equal("g", tokens[2].TokenString)
+	assert.Equal(3, tokenSet.Position(tokens[2]).Line)
+	assert.Equal(TOK_EOF, tokens[3].Type)
+
+	tokenSet = lexInputSet("a\n/* b\n\nc")
+	tokens = tokenSet.Tokens
+
+	assert.MustEqual(3, len(tokens))
+	assert.Equal(TOK_ERROR, tokens[1].Type)
+	assert.Equal("unterminated comment", tokens[1].TokenString)
+	assert.Equal(2, tokenSet.Position(tokens[1]).Line)
+	assert.Equal(TOK_EOF, tokens[2].Type)
+
+	// the tokens of an unterminated comment still end in EOF, so they parse
+	tokenSet, err := LexString("t.xxx", "int main(void) { return 0; } /* x", &Options{KeepTrivia: true})
+	assert.MustNotNil(err)
+	assert.Equal(TOK_EOF, tokenSet.Tokens[len(tokenSet.Tokens)-1].Type)
+
+	parser := NewParserFromTokens(tokenSet, &Options{})
+	assert.False(parser.DoParse())
+	assert.Equal("t.xxx:1:30: error: expected declaration, found 'unterminated comment'", parser.Diagnostics.Error())
+}
+
+func TestLexWarnings(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	src := "int x; /* a /* b */\n#define N 1\n#define N 2\nint main(void) {\n  return 0; /* /* */\n}\n"
+	opts := &Options{WarnNestedComment: true}
+	expected := []string{
+		"t.xxx:1:13: warning: \"/*\" within comment",
+		"t.xxx:3: warning: N redefined",
+		"t.xxx:5:16: warning: \"/*\" within comment",
+	}
+
+	// the warnings are left with the tokens, and the parser reports them
+	// along with its own diagnostics
+	tokens, err := LexString("t.xxx", src, opts)
+	assert.MustNil(err)
+	assert.MustEqual(3, len(tokens.Warnings))
+
+	parser := NewParserFromTokens(tokens, opts)
+	assert.True(parser.DoParse())
+	assert.MustEqual(3, len(parser.Diagnostics))
+
+	stream, err := LexStream("t.xxx", strings.NewReader(src), opts)
+	assert.MustNil(err)
+	defer stream.Close()
+
+	streamParser := NewParserFromSource(stream, opts)
+	assert.True(streamParser.DoParse())
+	assert.MustEqual(3, len(streamParser.Diagnostics))
+
+	for i, message := range expected {
+		assert.Equal(message, tokens.Warnings[i].Error())
+		assert.Equal(message, parser.Diagnostics[i].Error())
+		assert.Equal(message, streamParser.Diagnostics[i].Error())
+	}
+
+	// a parser that gives up reports no warnings past that point
+	src = "int x = ;\nint y = ;\n/* /* */\n"
+	tokens, err = LexString("t.xxx", src, &Options{WarnNestedComment: true, MaxErrors: 1})
+	assert.MustNil(err)
+
+	parser = NewParserFromTokens(tokens, &Options{MaxErrors: 1})
+	assert.False(parser.DoParse())
+	assert.Equal(2, len(parser.Diagnostics))
+	assert.Equal(0, len(parser.Diagnostics)-len(parser.Diagnostics.Errors()))
+}
+
+func TestTokenPositions(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	dir := writeTestFiles(t, map[string]string{
+		"main.xxx": "#define TWICE(x) ((x) + (x))\n" +
+			"int f(int a) {\n" +
+			"\treturn TWICE(a)  +\\\n" +
+			"  a;\n" +
+			"}\n"})
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "main.xxx")
+	tokenSet := LexicalAnalysis(filename)
+	tokens := tokenSet.Tokens
+
+	assert.MustEqual(22, len(tokens))
+
+	// int
+	assert.Equal(filename, tokenSet.Position(tokens[0]).Filename)
+	assert.Equal(2, tokenSet.Position(tokens[0]).Line)
+	assert.Equal(1, tokenSet.Position(tokens[0]).Column)
+
+	// a in the parameter list
+	position := tokenSet.FileSet.Position(tokens[4].Pos)
+	assert.Equal("a", tokens[4].TokenString)
+	assert.Equal(Position{filename, 39, 2, 11}, position)
+	assert.Equal(40, tokenSet.FileSet.Position(tokens[4].End).Offset)
+
+	// return
+	assert.Equal(3, tokenSet.Position(tokens[7]).Line)
+	assert.Equal(2, tokenSet.Position(tokens[7]).Column)
+
+	// every token of TWICE(a) spans the invocation
+	for _, token := range tokens[8:17] {
+		assert.Equal(3, tokenSet.Position(token).Line)
+		assert.Equal(9, tokenSet.Position(token).Column)
+		assert.Equal(tokens[8].End, token.End)
+	}
+
+	assert.Equal(8, tokenSet.FileSet.Position(tokens[8].End).Column-tokenSet.Position(tokens[8]).Column)
+
+	// the a after the line continuation
+	assert.Equal("a", tokens[18].TokenString)
+	assert.Equal(4, tokenSet.Position(tokens[18]).Line)
+	assert.Equal(3, tokenSet.Position(tokens[18]).Column)
+}
+
+func TestLexErrors(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokenSet := lexInputSet("a @ 12ab 0x1f 99999999999\n\"\\q\" \"open\nb $")
+	tokens := tokenSet.Tokens
+	expected := []struct {
+		tokenType TokenType
+		str       string
+		line      int
+		column    int
+	}{
+		{TOK_IDENTIFIER, "a", 1, 1},
+		{TOK_ERROR, "invalid character '@'", 1, 3},
+		{TOK_ERROR, "invalid integer constant 12ab", 1, 5},
+		{TOK_ERROR, "invalid integer constant 0x1f", 1, 10},
+		{TOK_ERROR, "integer constant 99999999999 is too large", 1, 15},
+		{TOK_ERROR, "invalid escape sequence in string literal \"\\q\"", 2, 1},
+		{TOK_ERROR, "missing terminating \" character", 2, 6},
+		{TOK_IDENTIFIER, "b", 3, 1},
+		{TOK_ERROR, "invalid character '$'", 3, 3},
+		{TOK_EOF, "", 3, 4},
+	}
+
+	assert.MustEqual(len(expected), len(tokens))
+
+	for i, e := range expected {
+		assert.Equal(e.tokenType, tokens[i].Type)
+		assert.Equal(e.str, tokens[i].TokenString)
+		position := tokenSet.Position(tokens[i])
+		assert.Equal(e.line, position.Line)
+		assert.Equal(e.column, position.Column)
+	}
+}
+
+func TestLexKeepTrivia(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	src := "#include <x.h>\n#define A \\\n  1\n\n/* doc */\nint  main(void) { // entry\n\treturn 0 @ ; /* a\n b */ }\n"
+
+	tokenSet, err := LexString("t.xxx", src, &Options{KeepTrivia: true})
+	assert.MustNotNil(err)
+	assert.Equal("t.xxx:7:11: error: invalid character '@'", err.Error())
+
+	src = strings.Replace(src, "@ ", "", 1)
+	tokenSet, err = LexString("t.xxx", src, &Options{KeepTrivia: true})
+	assert.MustNil(err)
+
+	text := ""
+
+	for i := range tokenSet.Tokens {
+		text += tokenSet.FullText(i)
+	}
+
+	assert.Equal(src, text)
+
+	tokens := tokenSet.Tokens
+	assert.Equal("int", tokens[0].TokenString)
+	assert.Equal(7, len(tokenSet.Leading(0)))
+	assert.Equal(Trivia{Trivia_directive, "#define A \\\n  1"}, tokenSet.Leading(0)[2])
+	assert.Equal(Trivia{Trivia_comment, "/* doc */"}, tokenSet.Leading(0)[5])
+	assert.Equal(6, tokenSet.Position(tokens[0]).Line)
+
+	// "{" keeps the line comment, "return" starts with the newline and tab
+	assert.Equal([]Trivia{{Trivia_space, " "}, {Trivia_comment, "// entry"}}, tokenSet.Trailing(5))
+	assert.Equal([]Trivia{{Trivia_newline, "\n"}, {Trivia_space, "\t"}}, tokenSet.Leading(6))
+
+	// a comment starting on the line of ";" trails it even across lines
+	assert.Equal([]Trivia{{Trivia_space, " "}, {Trivia_comment, "/* a\n b */"}, {Trivia_space, " "}}, tokenSet.Trailing(8))
+	assert.Equal(TOK_EOF, tokens[10].Type)
+	assert.Equal([]Trivia{{Trivia_newline, "\n"}}, tokenSet.Leading(10))
+
+	// the lossless tokens parse like preprocessed ones
+	assert.True(NewParserFromTokens(tokenSet, &Options{}).DoParse())
+
+	// an error token keeps what it rejected
+	tokenSet = lexInputKeepingTrivia("a 12ab b")
+	assert.Equal("a 12ab b", tokenSet.FullText(0)+tokenSet.FullText(1)+tokenSet.FullText(2))
+	assert.Equal([]Trivia{{Trivia_skipped, "12ab"}, {Trivia_space, " "}}, tokenSet.Trailing(1))
+}
+
+func lexInputKeepingTrivia(input string) *TokenSet {
+	l := NewLexer(input)
+	l.keepTrivia = true
+	l.run()
+
+	return l.tokens
+}
+
+// The lexing benchmarks take the input as written and as preprocessed; the
+// latter includes the cost of the preprocessor.
+func BenchmarkLex(b *testing.B) {
+	src := generateSource(5000)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		NewLexer(src).run()
+	}
+}
+
+func BenchmarkLexPreprocessed(b *testing.B) {
+	src := generateSource(5000)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		LexString("gen.xxx", src, &Options{})
+	}
+}
+
+// BenchmarkLexLongLine preprocesses and lexes the source of
+// BenchmarkLexPreprocessed with its lines joined into one and a macro used
+// in every function. The time per byte stays the same as the line grows.
+func BenchmarkLexLongLine(b *testing.B) {
+	for _, n := range []int{1000, 4000} {
+		src := "#define ONE 1\n" + strings.Replace(strings.Replace(generateSource(n), "c - 1", "c - ONE", -1), "\n", " ", -1)
+
+		b.Run(fmt.Sprint("functions=", n), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := LexString("gen.xxx", src, &Options{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLexLineBreaksAndEncoding(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	// a byte order mark is dropped, or kept as trivia, and CRLF or CR end
+	// lines like LF
+	src := "\xef\xbb\xbfint a;\r\n#define B \\\r\n 2\r\nint b = B;\rint c;\n"
+	tokenSet, err := LexString("t.xxx", src, &Options{})
+	assert.MustNil(err)
+
+	tokens := tokenSet.Tokens
+	assert.Equal(12, len(tokens))
+	assert.Equal(TOK_INT, tokens[0].Type)
+	assert.Equal(1, tokenSet.Position(tokens[0]).Column)
+	assert.Equal(2, tokens[6].Number)
+	assert.Equal(4, tokenSet.Position(tokens[4]).Line)
+	assert.Equal("c", tokens[9].TokenString)
+	assert.Equal(5, tokenSet.Position(tokens[9]).Line)
+	assert.Equal(5, tokenSet.Position(tokens[9]).Column)
+
+	tokenSet, err = LexString("t.xxx", src, &Options{KeepTrivia: true})
+	assert.MustNil(err)
+
+	text := ""
+
+	for i := range tokenSet.Tokens {
+		text += tokenSet.FullText(i)
+	}
+
+	assert.Equal(src, text)
+	assert.Equal([]Trivia{{Trivia_bom, "\xef\xbb\xbf"}}, tokenSet.Leading(0))
+	assert.Equal(1, tokenSet.Position(tokenSet.Tokens[0]).Column)
+	assert.Equal([]Trivia{{Trivia_newline, "\r\n"}, {Trivia_directive, "#define B \\\r\n 2"}, {Trivia_newline, "\r\n"}},
+		tokenSet.Leading(3))
+	assert.Equal([]Trivia{{Trivia_newline, "\r"}}, tokenSet.Leading(8))
+	assert.Equal(5, tokenSet.Position(tokenSet.Tokens[8]).Line)
+
+	// bytes that are not UTF-8 are rejected where they are
+	_, err = LexString("t.xxx", "int a; \xff\nchar *s = \"b\xfe\";\n/* \xc3 */ int\xe2\x82\xac;\n", &Options{})
+	assert.MustNotNil(err)
+
+	errs := err.(DiagnosticList)
+	assert.MustEqual(4, len(errs))
+	assert.Equal("t.xxx:1:8: error: invalid UTF-8 encoding", errs[0].Error())
+	assert.Equal("t.xxx:2:13: error: invalid UTF-8 encoding in string literal", errs[1].Error())
+	assert.Equal("t.xxx:3:4: error: invalid UTF-8 encoding in comment", errs[2].Error())
+	assert.Equal("t.xxx:3:12: error: invalid character '€'", errs[3].Error())
+
+	// letters other than ASCII ones only make identifiers when allowed
+	_, err = LexString("t.xxx", "int día;", &Options{})
+	assert.MustNotNil(err)
+	assert.Equal("t.xxx:1:6: error: invalid character 'í'", err.Error())
+
+	tokenSet, err = LexString("t.xxx", "int día = 名前1;", &Options{UnicodeIdentifiers: true})
+	assert.MustNil(err)
+	assert.Equal("día", tokenSet.Tokens[1].TokenString)
+	assert.Equal("名前1", tokenSet.Tokens[3].TokenString)
+	assert.Equal(TOK_IDENTIFIER, tokenSet.Tokens[3].Type)
 }
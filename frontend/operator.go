@@ -0,0 +1,48 @@
+package frontend
+
+type Associativity int
+
+const (
+	Assoc_left  Associativity = 0
+	Assoc_right Associativity = 1
+)
+
+// Operator describes an operator of the expression parser. Operators with a
+// higher Prec bind more tightly, and Assoc groups a chain of operators with
+// the same Prec. Unary operators are prefix operators.
+type Operator struct {
+	Token TokenType
+	Op    string
+	Prec  int
+	Assoc Associativity
+	Unary bool
+}
+
+// operatorTable lists the operators of expressions, loosest first. An
+// operator is added to the language by adding it here, and to the code
+// generator.
+var operatorTable = []Operator{
+	{TOK_ASSIGN, "=", 1, Assoc_right, false},
+	{TOK_PLUS, "+", 2, Assoc_left, false},
+	{TOK_MINUS, "-", 2, Assoc_left, false},
+	{TOK_STAR, "*", 3, Assoc_left, false},
+	{TOK_SLASH, "/", 3, Assoc_left, false},
+	{TOK_MINUS, "-", 4, Assoc_right, true},
+	{TOK_STAR, "*", 4, Assoc_right, true},
+}
+
+var binaryOperators, unaryOperators = indexOperators()
+
+func indexOperators() (binary [len(tokenNames)]*Operator, unary [len(tokenNames)]*Operator) {
+	for i := range operatorTable {
+		op := &operatorTable[i]
+
+		if op.Unary {
+			unary[op.Token] = op
+		} else {
+			binary[op.Token] = op
+		}
+	}
+
+	return
+}
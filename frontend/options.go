@@ -0,0 +1,115 @@
+package frontend
+
+import (
+	"flag"
+	"strings"
+)
+
+// Options controls how a source file is preprocessed and parsed. Asserts
+// are compiled away when NoAssert is set or NDEBUG is defined.
+type Options struct {
+	IncludePaths []string
+	Defines      map[string]string
+	NoAssert     bool
+
+	// WarnNestedComment warns about "/*" inside a block comment, which
+	// usually means the previous comment was not closed.
+	WarnNestedComment bool
+
+	// KeepTrivia lexes the source as written, without preprocessing, and
+	// attaches whitespace, comments and directives to the tokens so that
+	// the source can be reproduced from them.
+	KeepTrivia bool
+
+	// UnicodeIdentifiers allows letters and digits other than ASCII ones in
+	// identifiers, which must not start with a digit all the same.
+	UnicodeIdentifiers bool
+
+	// MaxErrors stops parsing after that many errors, and with it the
+	// reporting of warnings. 0 means no limit.
+	MaxErrors int
+}
+
+// orDefault returns o, or the default options for a nil o, which every
+// function taking options accepts.
+func (o *Options) orDefault() *Options {
+	if o == nil {
+		return &Options{}
+	}
+
+	return o
+}
+
+func (o *Options) assertDisabled() bool {
+	_, ndebug := o.Defines["NDEBUG"]
+
+	return o.NoAssert || ndebug
+}
+
+type includeFlag Options
+
+func (f *includeFlag) String() string {
+	return strings.Join(f.IncludePaths, ":")
+}
+
+func (f *includeFlag) Set(dir string) error {
+	f.IncludePaths = append(f.IncludePaths, dir)
+
+	return nil
+}
+
+type defineFlag Options
+
+func (f *defineFlag) String() string {
+	defines := []string{}
+
+	for name, value := range f.Defines {
+		defines = append(defines, name+"="+value)
+	}
+
+	return strings.Join(defines, " ")
+}
+
+func (f *defineFlag) Set(define string) error {
+	name, value := define, "1"
+
+	if i := strings.Index(define, "="); i >= 0 {
+		name, value = define[:i], define[i+1:]
+	}
+
+	if f.Defines == nil {
+		f.Defines = make(map[string]string)
+	}
+
+	f.Defines[name] = value
+
+	return nil
+}
+
+// SetFlags registers the -I, -D, -no-assert, -Wcomment,
+// -fextended-identifiers and -fmax-errors command-line options on fs.
+func (o *Options) SetFlags(fs *flag.FlagSet) {
+	fs.Var((*includeFlag)(o), "I", "add `dir` to the include search path")
+	fs.Var((*defineFlag)(o), "D", "define macro `name[=value]`")
+	fs.BoolVar(&o.NoAssert, "no-assert", false, "compile assert statements away, as -DNDEBUG does")
+	fs.BoolVar(&o.WarnNestedComment, "Wcomment", false, "warn about \"/*\" within a block comment")
+	fs.BoolVar(&o.UnicodeIdentifiers, "fextended-identifiers", false, "allow Unicode letters in identifiers")
+	fs.IntVar(&o.MaxErrors, "fmax-errors", 20, "stop after `n` errors, or never if 0")
+}
+
+// SplitShortFlags rewrites C style arguments such as -Idir and -DNAME=1
+// into the "-I dir" form understood by the flag package.
+func SplitShortFlags(args []string) []string {
+	result := []string{}
+
+	for _, arg := range args {
+		if len(arg) > 2 && (strings.HasPrefix(arg, "-I") || strings.HasPrefix(arg, "-D")) &&
+			arg[2] != '=' {
+			result = append(result, arg[:2], arg[2:])
+		} else {
+			result = append(result, arg)
+		}
+	}
+
+	return result
+}
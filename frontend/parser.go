@@ -2,138 +2,598 @@ package frontend
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
 type Parser struct {
-	*TokenSet
+	TokenSource
 	TU             *TranslationUnitAST
-	VariableTable  []string
-	PrototypeTable map[string]int
-	FunctionTable  map[string]int
+	VariableTable  map[string]*VariableDeclAST
+	GlobalTable    map[string]*VariableDeclAST
+	PrototypeTable map[string]*PrototypeAST
+	FunctionTable  map[string]*PrototypeAST
+	LinkageTable   map[string]StorageClass
+	NoAssert       bool
+
+	// Diagnostics holds the errors and warnings of DoParse. furthest is
+	// where the parse got stuck, reported when it fails for no other reason.
+	// lastError is the message of the last error found, which the error
+	// node of a failed statement keeps. Parsing stops once more than
+	// maxErrors errors are found, if it is not 0.
+	Diagnostics DiagnosticList
+	furthest    expectation
+	lastError   string
+	errors      int
+	maxErrors   int
+	gaveUp      bool
+
+	// committed is the index of the current token at the last commit,
+	// which the parser cannot back up past
+	committed int
+
+	// checker is the Checker of a successful parse
+	checker *Checker
 }
 
 func NewParser(filename string) *Parser {
-	tokens := LexicalAnalysis(filename)
+	return NewParserWithOptions(filename, &Options{})
+}
+
+func NewParserWithOptions(filename string, opts *Options) *Parser {
+	return NewParserFromTokens(LexicalAnalysisWithOptions(filename, opts), opts)
+}
+
+// NewParserFromTokens returns a parser for tokens produced by Lex. The parse
+// runs up to an EOF token, which is added after the last token of a set
+// that lacks one.
+func NewParserFromTokens(tokens *TokenSet, opts *Options) *Parser {
+	if tokens == nil {
+		return NewParserFromSource(nil, opts)
+	}
+
+	if n := len(tokens.Tokens); n == 0 || tokens.Tokens[n-1].Type != TOK_EOF {
+		eof := &Token{Type: TOK_EOF}
+
+		if n > 0 {
+			last := tokens.Tokens[n-1]
+			eof.Pos, eof.End = last.End, last.End
+		}
+
+		terminated := *tokens
+		terminated.Tokens = append(tokens.Tokens[:n:n], eof)
+		tokens = &terminated
+	}
+
+	return NewParserFromSource(tokens, opts)
+}
+
+// NewParserFromSource returns a parser reading from source, such as a
+// TokenStream.
+func NewParserFromSource(source TokenSource, opts *Options) *Parser {
+	opts = opts.orDefault()
 
 	return &Parser{
-		TokenSet:       tokens,
-		VariableTable:  []string{},
-		PrototypeTable: make(map[string]int),
-		FunctionTable:  make(map[string]int)}
+		TokenSource:    source,
+		VariableTable:  make(map[string]*VariableDeclAST),
+		GlobalTable:    make(map[string]*VariableDeclAST),
+		PrototypeTable: make(map[string]*PrototypeAST),
+		FunctionTable:  make(map[string]*PrototypeAST),
+		LinkageTable:   make(map[string]StorageClass),
+		NoAssert:       opts.assertDisabled(),
+		maxErrors:      opts.MaxErrors}
 }
 
 func (p *Parser) GetAST() (tu *TranslationUnitAST) {
 	if p.TU != nil {
 		tu = p.TU
 	} else {
-		tu = &TranslationUnitAST{[]*PrototypeAST{}, []*FunctionAST{}}
+		tu = &TranslationUnitAST{[]*PrototypeAST{}, []*FunctionAST{}, []*VariableDeclAST{}, []*ErrorAST{}}
 	}
 
 	return
 }
 
-func (p *Parser) DoParse() (result bool) {
-	if p.TokenSet != nil {
-		result = p.visitTranslationUnit()
-	} else {
-		panic("error at lexer\n")
+// DoParse parses and checks the translation unit, leaving what it finds in
+// Diagnostics. The parse goes on past syntax errors to report as many as it
+// can, but the translation unit is only checked when there are none. It
+// fails without a diagnostic when there are no tokens, as lexing has
+// reported its errors.
+func (p *Parser) DoParse() bool {
+	if p.TokenSource == nil {
+		return false
 	}
 
-	return
+	file := p.position(p.tokenAt(p.getCurIndex())).Filename
+
+	if !p.visitTranslationUnit() {
+		return false
+	}
+
+	p.checker = NewChecker()
+	p.checker.fset = p.fileSet()
+	p.checker.file = file
+	ok := p.checker.Check(p.TU)
+	p.Diagnostics = append(p.Diagnostics, p.checker.Diagnostics...)
+
+	return ok
+}
+
+// CheckMain is Checker.CheckMain for the translation unit of a successful
+// DoParse, adding what it finds to Diagnostics.
+func (p *Parser) CheckMain() bool {
+	if p.checker == nil {
+		return false
+	}
+
+	found := len(p.checker.Diagnostics)
+	ok := p.checker.CheckMain(p.TU)
+	p.Diagnostics = append(p.Diagnostics, p.checker.Diagnostics[found:]...)
+
+	return ok
+}
+
+// maxUncommitted is how many tokens a function body may run on for before
+// the parser commits between its statements, so that a TokenStream does not
+// hold all of a long function at once.
+const maxUncommitted = 256
+
+// commit tells the token source that the tokens before the current one are
+// no longer needed.
+func (p *Parser) commit() {
+	p.TokenSource.commit()
+	p.committed = p.getCurIndex()
+}
+
+// curPos returns the position of the current token.
+func (p *Parser) curPos() Pos {
+	return p.tokenAt(p.getCurIndex()).Pos
+}
+
+func (p *Parser) position(token *Token) Position {
+	return p.fileSet().Position(token.Pos)
+}
+
+// errorf reports an error at the token at index.
+func (p *Parser) errorf(index int, format string, args ...interface{}) {
+	p.report(p.tokenAt(index), fmt.Sprintf(format, args...))
+}
+
+// report adds an error at token to Diagnostics. Recovery may stop at the
+// token an error was found at when it starts a line, as it usually starts
+// the next statement, and that statement can then fail at the same token;
+// the same error is not repeated then. Past the error limit, the parser
+// gives up instead.
+func (p *Parser) report(token *Token, msg string) {
+	if p.gaveUp {
+		return
+	}
+
+	p.lastError = msg
+	d := &Diagnostic{p.position(token), Severity_error, msg}
+
+	if last := len(p.Diagnostics) - 1; last >= 0 && *p.Diagnostics[last] == *d {
+		return
+	}
+
+	if p.maxErrors > 0 && p.errors == p.maxErrors {
+		d.Msg = fmt.Sprintf("too many errors, stopping now (limit %d)", p.maxErrors)
+		p.gaveUp = true
+	}
+
+	p.errors++
+	p.Diagnostics = append(p.Diagnostics, d)
+}
+
+// reportWarnings adds the warnings found while lexing the source up to the
+// current token to Diagnostics, unless the parser has given up.
+func (p *Parser) reportWarnings() {
+	if !p.gaveUp {
+		p.Diagnostics = append(p.Diagnostics, p.takeWarnings(p.getCurIndex())...)
+	}
+}
+
+// expect records that what was expected at the current token, where an
+// alternative of the grammar fails.
+func (p *Parser) expect(what string) {
+	p.furthest.add(p.getCurIndex(), p.tokenAt(p.getCurIndex()), what)
+}
+
+// Parse parses the source read from r, using name in diagnostics. Parse
+// errors are returned as a DiagnosticList.
+func Parse(name string, r io.Reader, opts *Options) (*TranslationUnitAST, error) {
+	opts = opts.orDefault()
+	tokens, err := Lex(name, r, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parser := NewParserFromTokens(tokens, opts)
+
+	if !parser.DoParse() {
+		return nil, parser.Diagnostics
+	}
+
+	return parser.GetAST(), nil
+}
+
+// ParseString is Parse for source held in memory.
+func ParseString(name string, src string, opts *Options) (*TranslationUnitAST, error) {
+	return Parse(name, strings.NewReader(src), opts)
 }
 
 func (p *Parser) visitTranslationUnit() bool {
-	p.TU = &TranslationUnitAST{[]*PrototypeAST{}, []*FunctionAST{}}
+	p.TU = &TranslationUnitAST{[]*PrototypeAST{}, []*FunctionAST{}, []*VariableDeclAST{}, []*ErrorAST{}}
 
 	// printnum
-	paramList := []string{"i"}
-	p.TU.Prototypes = append(p.TU.Prototypes, &PrototypeAST{"printnum", paramList})
-	p.PrototypeTable["printnum"] = 1
+	printnum := &PrototypeAST{
+		Name:       "printnum",
+		Params:     []string{"i"},
+		ParamTypes: []*TypeAST{intType()}}
+	p.TU.Prototypes = append(p.TU.Prototypes, printnum)
+	p.PrototypeTable["printnum"] = printnum
+	p.LinkageTable["printnum"] = Storage_none
 
 	for {
+		start := p.getCurIndex()
+		errors := p.errors
+		p.reportWarnings()
+
 		if !p.visitExternalDeclaration(p.TU) {
-			return false
+			p.TU.Errors = append(p.TU.Errors, p.recover(start, errors, true))
 		}
 
-		if p.getCurType() == TOK_EOF {
+		// declarations are never backtracked into once parsed, so what
+		// failed inside them no longer matters
+		p.commit()
+		p.furthest = expectation{}
+
+		if p.getCurType() == TOK_EOF || p.gaveUp {
 			break
 		}
 	}
 
-	return true
+	p.reportWarnings()
+
+	return p.errors == 0
 }
 
+// visitExternalDeclaration parses a declaration at file scope. Function
+// declarations, function definitions and variable declarations all start
+// with a storage class, a type and a declarator, so these are parsed once
+// and the token after them tells which one it is.
 func (p *Parser) visitExternalDeclaration(tunit *TranslationUnitAST) bool {
 	debug("visitExternalDeclaration")
-	proto := p.visitFunctionDeclaration()
 
-	if proto != nil {
-		tunit.Prototypes = append(tunit.Prototypes, proto)
-		return true
+	start := p.getCurIndex()
+
+	if len(p.VariableTable) > 0 {
+		p.VariableTable = make(map[string]*VariableDeclAST)
+	}
+
+	if !startsDeclaration(p.getCurType()) {
+		p.expect("declaration")
+		return false
 	}
 
-	funcDef := p.visitFunctionDefinition()
+	storage, baseType, name, pos, declType := p.visitDeclarationHead()
 
-	if funcDef != nil {
-		tunit.Functions = append(tunit.Functions, funcDef)
-		return true
+	if declType == nil {
+		return false
 	}
 
-	return false
+	// a function returns int, and its declarator is just its name
+	if p.getCurType() == TOK_LPAREN && declType == baseType && sameType(baseType, intType()) {
+		proto := p.visitPrototype(storage, name, pos)
+
+		if proto == nil {
+			return false
+		}
+
+		if p.getCurType() == TOK_SEMICOLON {
+			if !p.visitFunctionDeclaration(proto, start) {
+				return false
+			}
+
+			tunit.Prototypes = append(tunit.Prototypes, proto)
+			return true
+		}
+
+		if p.getCurType() == TOK_LBRACE {
+			funcDef := p.visitFunctionDefinition(proto, start)
+
+			if funcDef == nil {
+				return false
+			}
+
+			tunit.Functions = append(tunit.Functions, funcDef)
+			return true
+		}
+
+		p.expect("';'")
+		p.expect("'{'")
+		return false
+	}
+
+	vdecl := p.visitVariableDeclaration(storage, name, pos, declType)
+
+	if vdecl == nil || !p.declareGlobal(vdecl, start) {
+		return false
+	}
+
+	tunit.Variables = append(tunit.Variables, vdecl)
+	return true
 }
 
-func (p *Parser) visitFunctionDeclaration() (result *PrototypeAST) {
-	debug("visitFunctionDeclaration")
+// declareGlobal adds vdecl, declared at index, to the global variables.
+func (p *Parser) declareGlobal(vdecl *VariableDeclAST, index int) bool {
+	vdecl.Type = Decl_global
 
-	bkup := p.getCurIndex()
-	proto := p.visitPrototype()
+	if _, isFunction := p.LinkageTable[vdecl.Name]; isFunction {
+		p.errorf(index, "Variable: %s is redeclared as a different kind of symbol", vdecl.Name)
+		return false
+	}
 
-	if proto == nil {
-		return nil
+	if !isConstantInitializer(vdecl.Init) {
+		p.errorf(index, "Variable: initializer of %s is not a constant", vdecl.Name)
+		return false
 	}
 
-	if p.getCurString() == ";" {
-		_, isInPrototypeTable := p.PrototypeTable[proto.Name]
-		_, isInFunctionTable := p.FunctionTable[proto.Name]
+	if prev, ok := p.GlobalTable[vdecl.Name]; ok {
+		if !sameType(prev.VarType, vdecl.VarType) {
+			p.errorf(index, "Variable: %s is redeclared with a different type", vdecl.Name)
+			return false
+		}
 
-		if isInPrototypeTable ||
-			(isInFunctionTable && p.FunctionTable[proto.Name] != len(proto.Params)) {
-			fmt.Fprintf(os.Stderr, "Function: %s is redefined\n", proto.Name)
-			return nil
+		// a later declaration without "static" has external linkage unless
+		// it is "extern", which inherits the linkage of the earlier one
+		if (prev.Storage == Storage_static) != (vdecl.Storage == Storage_static) &&
+			!(prev.Storage == Storage_static && vdecl.Storage == Storage_extern) {
+			p.errorf(index, "Variable: %s is redeclared with conflicting storage class", vdecl.Name)
+			return false
 		}
 
-		p.PrototypeTable[proto.Name] = len(proto.Params)
+		if prev.Init != nil && vdecl.Init != nil {
+			p.errorf(index, "Variable: %s is redefined", vdecl.Name)
+			return false
+		}
 
-		p.getNextToken()
-		result = proto
+		if prev.Storage == Storage_static {
+			vdecl.Storage = Storage_static
+		}
+	}
+
+	if prev, ok := p.GlobalTable[vdecl.Name]; !ok || prev.Init == nil {
+		p.GlobalTable[vdecl.Name] = vdecl
+	}
+
+	return true
+}
+
+// isConstantInitializer tells whether init may initialize a variable with
+// static storage: a number or the address of a function.
+func isConstantInitializer(init AST) bool {
+	return init == nil || init.GetID() == NumberID || init.GetID() == FunctionRefID
+}
+
+// checkLinkage reports a function declared "static" after it was declared
+// with external linkage, at the declaration starting at index. A later
+// declaration without "static" inherits the internal linkage of an earlier
+// static one.
+func (p *Parser) checkLinkage(proto *PrototypeAST, index int) bool {
+	if _, isVariable := p.GlobalTable[proto.Name]; isVariable {
+		p.errorf(index, "Function: %s is redeclared as a different kind of symbol", proto.Name)
+		return false
+	}
+
+	if prev, ok := p.LinkageTable[proto.Name]; ok {
+		if proto.Storage == Storage_static && prev != Storage_static {
+			p.errorf(index, "Function: static declaration of %s follows non-static declaration", proto.Name)
+			return false
+		}
 	} else {
-		p.applyTokenIndex(bkup)
+		p.LinkageTable[proto.Name] = proto.Storage
+	}
+
+	return true
+}
+
+// visitDeclarationHead parses the storage class, type specifier and
+// declarator a declaration starts with, and returns the name declared and
+// its position. declType is nil if they fail to parse or the declarator
+// has no name.
+func (p *Parser) visitDeclarationHead() (storage StorageClass, baseType *TypeAST, name string, pos Pos, declType *TypeAST) {
+	debug("visitDeclarationHead")
+
+	start := p.getCurIndex()
+	storage, ok := p.visitStorageClass()
+
+	if !ok {
+		p.errorf(start, "multiple storage classes in declaration")
+		return
+	}
+
+	if baseType = p.visitTypeSpecifier(); baseType == nil {
+		return
+	}
+
+	if name, pos, declType = p.visitDeclarator(baseType); declType != nil && name == "" {
+		p.expect("identifier")
+		declType = nil
+	}
+
+	return
+}
+
+// visitDeclarator parses the declarator following a type specifier: an
+// identifier, or "(*name)(parameter types)" declaring a pointer to a function
+// returning baseType. The name is empty for an abstract declarator, and
+// declType nil if the declarator fails to parse. pos is the position of the
+// name.
+func (p *Parser) visitDeclarator(baseType *TypeAST) (name string, pos Pos, declType *TypeAST) {
+	debug("visitDeclarator")
+
+	if p.getCurType() == TOK_IDENTIFIER {
+		name, pos = p.getCurString(), p.curPos()
+		p.getNextToken()
+		return name, pos, baseType
+	}
+
+	if p.getCurType() != TOK_LPAREN {
+		return "", NoPos, baseType
+	}
+
+	p.getNextToken()
+
+	if p.getCurType() != TOK_STAR {
+		p.expect("'*'")
+		return "", NoPos, nil
+	}
+
+	p.getNextToken()
+	isConst := p.visitTypeQualifiers()
+
+	if p.getCurType() == TOK_IDENTIFIER {
+		name, pos = p.getCurString(), p.curPos()
+		p.getNextToken()
+	}
+
+	if p.getCurType() != TOK_RPAREN {
+		p.expect("')'")
+		return "", NoPos, nil
+	}
+
+	p.getNextToken()
+
+	funcType := p.visitParameterTypeList(baseType)
+
+	if funcType == nil {
+		return "", NoPos, nil
+	}
+
+	declType = pointerTo(funcType)
+	declType.Const = isConst
+
+	return name, pos, declType
+}
+
+// visitParameterTypeList parses the parenthesized parameters of a function
+// type. Parameter names are optional and ignored.
+func (p *Parser) visitParameterTypeList(retType *TypeAST) *TypeAST {
+	debug("visitParameterTypeList")
+
+	if p.getCurType() != TOK_LPAREN {
+		p.expect("'('")
 		return nil
 	}
 
+	params := p.visitParameters()
+
+	if params == nil {
+		return nil
+	}
+
+	return &TypeAST{ID: Type_function, Elem: retType, Params: params.ParamTypes, IsVarArg: params.IsVarArg}
+}
+
+func (p *Parser) visitTypeQualifiers() (isConst bool) {
+	for p.getCurType() == TOK_CONST {
+		isConst = true
+		p.getNextToken()
+	}
+
 	return
 }
 
-func (p *Parser) visitFunctionDefinition() *FunctionAST {
+// visitStorageClass parses an optional "static" or "extern". ok is false
+// when more than one is given.
+func (p *Parser) visitStorageClass() (storage StorageClass, ok bool) {
+	for {
+		var next StorageClass
+
+		if p.getCurType() == TOK_STATIC {
+			next = Storage_static
+		} else if p.getCurType() == TOK_EXTERN {
+			next = Storage_extern
+		} else {
+			return storage, true
+		}
+
+		if storage != Storage_none {
+			return storage, false
+		}
+
+		storage = next
+		p.getNextToken()
+	}
+}
+
+// startsType tells whether a token of type t may begin a type specifier.
+func startsType(t TokenType) bool {
+	return t == TOK_INT || t == TOK_CHAR || t == TOK_CONST
+}
+
+// startsDeclaration tells whether a token of type t may begin a declaration.
+func startsDeclaration(t TokenType) bool {
+	return startsType(t) || t == TOK_STATIC || t == TOK_EXTERN
+}
+
+// visitFunctionDeclaration declares the function of proto, whose
+// declaration starts at index, and skips the ';' after it.
+func (p *Parser) visitFunctionDeclaration(proto *PrototypeAST, index int) bool {
+	debug("visitFunctionDeclaration")
+
+	prev, isInPrototypeTable := p.PrototypeTable[proto.Name]
+
+	if !isInPrototypeTable {
+		prev = p.FunctionTable[proto.Name]
+	}
+
+	if prev != nil && !sameSignature(prev, proto) {
+		p.errorf(index, "Function: conflicting types for %s", proto.Name)
+		return false
+	}
+
+	if !p.checkLinkage(proto, index) {
+		return false
+	}
+
+	if !isInPrototypeTable {
+		p.PrototypeTable[proto.Name] = proto
+	}
+
+	p.getNextToken()
+
+	return true
+}
+
+// visitFunctionDefinition parses the body of the function of proto, whose
+// definition starts at index.
+func (p *Parser) visitFunctionDefinition(proto *PrototypeAST, index int) *FunctionAST {
 	debug("visitFunctionDefinition")
 
-	proto := p.visitPrototype()
+	if _, isInFunctionTable := p.FunctionTable[proto.Name]; isInFunctionTable {
+		p.errorf(index, "Function: %s is redefined", proto.Name)
+		return nil
+	}
 
-	if proto == nil {
+	if prev, ok := p.PrototypeTable[proto.Name]; ok && !sameSignature(prev, proto) {
+		p.errorf(index, "Function: conflicting types for %s", proto.Name)
 		return nil
-	} else {
-		_, isInPrototypeTable := p.PrototypeTable[proto.Name]
-		_, isInFunctionTable := p.FunctionTable[proto.Name]
+	}
 
-		if (isInPrototypeTable && p.PrototypeTable[proto.Name] != len(proto.Params)) ||
-			isInFunctionTable {
-			fmt.Fprintf(os.Stderr, "Function: %s is redefined\n", proto.Name)
+	for _, param := range proto.Params {
+		if param == "" {
+			p.errorf(index, "Function: parameter name omitted in definition of %s", proto.Name)
 			return nil
 		}
 	}
 
-	p.VariableTable = []string{}
+	if !p.checkLinkage(proto, index) {
+		return nil
+	}
 
 	funcStmt := p.visitFunctionStatement(proto)
 
@@ -141,460 +601,571 @@ func (p *Parser) visitFunctionDefinition() *FunctionAST {
 		return nil
 	}
 
-	p.FunctionTable[proto.Name] = len(proto.Params)
+	p.FunctionTable[proto.Name] = proto
 
 	return &FunctionAST{proto, funcStmt}
 }
 
-func (p *Parser) visitPrototype() *PrototypeAST {
+// visitPrototype parses the parameter list of the function name, declared
+// at pos, which starts at the current '('.
+func (p *Parser) visitPrototype(storage StorageClass, name string, pos Pos) *PrototypeAST {
 	debug("visitPrototype")
 
-	var name string
-
-	bkup := p.getCurIndex()
-	isFirstParam := true
-	paramList := []string{}
+	proto := p.visitParameters()
 
-	if p.getCurType() == TOK_INT {
-		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
-		return nil
+	if proto != nil {
+		proto.Name = name
+		proto.Storage = storage
+		proto.Pos = pos
 	}
 
-	if p.getCurType() == TOK_IDENTIFIER {
-		name = p.getCurString()
-		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
-		return nil
-	}
+	return proto
+}
 
-	if p.getCurType() == TOK_SYMBOL && p.getCurString() == "(" {
-		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
+// visitParameters parses a parenthesized parameter list into the
+// parameters of a prototype, leaving its name to the caller. The names of
+// the parameters are optional, which is only allowed in a declaration. An
+// array parameter such as "char *argv[]" is adjusted to a pointer.
+func (p *Parser) visitParameters() *PrototypeAST {
+	debug("visitParameters")
+
+	proto := &PrototypeAST{Params: []string{}, ParamTypes: []*TypeAST{}}
+	names := make(map[string]bool)
+
+	p.getNextToken()
+
+	if !p.visitVoidParameterList() {
 		return nil
 	}
 
-	for {
-		if !isFirstParam &&
-			p.getCurType() == TOK_SYMBOL &&
-			p.getCurString() == "," {
+	for p.getCurType() != TOK_RPAREN {
+		if len(proto.Params) > 0 {
+			if p.getCurType() != TOK_COMMA || proto.IsVarArg {
+				p.expect("')'")
+				return nil
+			}
+
 			p.getNextToken()
+
+			if p.getCurType() == TOK_ELLIPSIS {
+				proto.IsVarArg = true
+				p.getNextToken()
+				continue
+			}
 		}
 
-		if p.getCurType() == TOK_INT {
-			p.getNextToken()
-		} else {
-			break
+		paramType := p.visitTypeSpecifier()
+
+		if paramType == nil {
+			return nil
 		}
 
-		if p.getCurType() == TOK_IDENTIFIER {
-			for _, param := range paramList {
-				if param == p.getCurString() {
-					p.applyTokenIndex(bkup)
-					return nil
-				}
+		index := p.getCurIndex()
+		paramName, _, paramType := p.visitDeclarator(paramType)
+
+		if paramType == nil {
+			return nil
+		}
+
+		if p.getCurType() == TOK_LBRACKET {
+			p.getNextToken()
+
+			if p.getCurType() != TOK_RBRACKET {
+				p.expect("']'")
+				return nil
 			}
 
-			isFirstParam = false
-			paramList = append(paramList, p.getCurString())
 			p.getNextToken()
-		} else {
-			p.applyTokenIndex(bkup)
-			return nil
+			paramType = pointerTo(paramType)
 		}
+
+		if paramName != "" {
+			if names[paramName] {
+				p.errorf(index, "Function: redefinition of parameter %s", paramName)
+				return nil
+			}
+
+			names[paramName] = true
+		}
+
+		proto.Params = append(proto.Params, paramName)
+		proto.ParamTypes = append(proto.ParamTypes, paramType)
 	}
 
-	if p.getCurType() == TOK_SYMBOL && p.getCurString() == ")" {
-		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
-		return nil
+	p.getNextToken()
+
+	return proto
+}
+
+// visitVoidParameterList skips the "void" of an explicitly empty parameter
+// list "(void)", leaving the closing parenthesis to the caller. It fails if
+// anything else follows the "void".
+func (p *Parser) visitVoidParameterList() bool {
+	if p.getCurType() != TOK_VOID {
+		return true
+	}
+
+	p.getNextToken()
+
+	if p.getCurType() != TOK_RPAREN {
+		p.expect("')'")
+		return false
 	}
 
-	return &PrototypeAST{name, paramList}
+	return true
 }
 
-func (p *Parser) visitFunctionStatement(proto *PrototypeAST) (funcStmt *FunctionStmtAST) {
-	debug("visitFunctionStatement")
+// visitTypeSpecifier parses "int" or "char" followed by any number of '*',
+// each optionally qualified by "const". char is only supported as the target
+// of a pointer.
+func (p *Parser) visitTypeSpecifier() *TypeAST {
+	debug("visitTypeSpecifier")
 
-	bkup := p.getCurIndex()
+	var typeAST *TypeAST
 
-	if p.getCurString() == "{" {
-		p.getNextToken()
+	isConst := p.visitTypeQualifiers()
+
+	if p.getCurType() == TOK_INT {
+		typeAST = intType()
+	} else if p.getCurType() == TOK_CHAR {
+		typeAST = &TypeAST{ID: Type_char}
 	} else {
+		p.expect("type")
 		return nil
 	}
 
+	p.getNextToken()
+	typeAST.Const = p.visitTypeQualifiers() || isConst
+
+	for p.getCurType() == TOK_STAR {
+		p.getNextToken()
+		typeAST = pointerTo(typeAST)
+		typeAST.Const = p.visitTypeQualifiers()
+	}
+
+	if typeAST.ID == Type_char {
+		p.expect("'*'")
+		return nil
+	}
+
+	return typeAST
+}
+
+func (p *Parser) visitFunctionStatement(proto *PrototypeAST) (funcStmt *FunctionStmtAST) {
+	debug("visitFunctionStatement")
+
+	p.getNextToken()
+
 	funcStmt = &FunctionStmtAST{[]*VariableDeclAST{}, []AST{}}
 
 	for i, _ := range proto.Params {
-		vdecl := &VariableDeclAST{proto.Params[i], Decl_param, &BaseAST{VariableDeclID}}
-		p.VariableTable = append(p.VariableTable, vdecl.Name)
+		vdecl := &VariableDeclAST{
+			Name:    proto.Params[i],
+			Type:    Decl_param,
+			VarType: proto.ParamTypes[i],
+			BaseAST: &BaseAST{ID: VariableDeclID}}
+		p.VariableTable[vdecl.Name] = vdecl
 		funcStmt.VariableDecls = append(funcStmt.VariableDecls, vdecl)
 	}
 
-	for {
-		if vdecl := p.visitVariableDeclaration(); vdecl != nil {
-			vdecl.Type = Decl_local
+	// local declarations come before the statements, so the first statement
+	// ends them; a broken declaration does not
+	inDeclarations := true
 
-			for _, availableVdecl := range p.VariableTable {
-				if availableVdecl == vdecl.Name {
-					return nil
-				}
-			}
+	for p.getCurType() != TOK_RBRACE {
+		if p.getCurType() == TOK_EOF || p.gaveUp {
+			p.furthest = expectation{}
+			p.expect("'}'")
+			p.report(p.furthest.token, p.furthest.message())
+			return nil
+		}
 
-			p.VariableTable = append(p.VariableTable, vdecl.Name)
-			funcStmt.VariableDecls = append(funcStmt.VariableDecls, vdecl)
-		} else {
-			break
+		// a statement that parsed is never backtracked into
+		if p.getCurIndex()-p.committed >= maxUncommitted {
+			p.commit()
 		}
-	}
 
-	for {
-		if stmt := p.visitStatement(); stmt != nil {
+		start := p.getCurIndex()
+		errors := p.errors
+		p.furthest = expectation{}
+
+		if inDeclarations && startsDeclaration(p.getCurType()) {
+			if vdecl := p.visitLocalDeclaration(); vdecl != nil {
+				p.declareLocal(funcStmt, vdecl, start)
+				continue
+			}
+		} else if stmt := p.visitStatement(); stmt != nil {
+			inDeclarations = false
 			funcStmt.StmtLists = append(funcStmt.StmtLists, stmt)
-		} else {
-			break
+			continue
 		}
+
+		funcStmt.StmtLists = append(funcStmt.StmtLists, p.recover(start, errors, false))
 	}
 
 	if len(funcStmt.StmtLists) > 0 {
 		lastStmt := funcStmt.StmtLists[len(funcStmt.StmtLists)-1]
 
-		if lastStmt.GetID() != JumpStmtID {
-			p.applyTokenIndex(bkup)
+		if lastStmt.GetID() != JumpStmtID && lastStmt.GetID() != ErrorID {
+			p.errorf(p.getCurIndex(), "Function: %s must end with a return statement", proto.Name)
 			return nil
 		}
 	}
 
-	if p.getCurString() == "}" {
-		p.getNextToken()
-		return
-	} else {
-		p.applyTokenIndex(bkup)
-		return nil
-	}
+	p.getNextToken()
 
 	return
 }
 
-func (p *Parser) visitVariableDeclaration() *VariableDeclAST {
-	debug("visitVariableDeclaration")
+// declareLocal adds vdecl, declared at index, to the local variables of
+// funcStmt. A declaration in error is left out.
+func (p *Parser) declareLocal(funcStmt *FunctionStmtAST, vdecl *VariableDeclAST, index int) {
+	vdecl.Type = Decl_local
 
-	var name string
+	if vdecl.Storage == Storage_extern {
+		p.errorf(index, "Variable: extern is not supported for local variable %s", vdecl.Name)
+		return
+	}
 
-	bkup := p.getCurIndex()
+	if vdecl.Storage == Storage_static && !isConstantInitializer(vdecl.Init) {
+		p.errorf(index, "Variable: initializer of static %s is not a constant", vdecl.Name)
+		return
+	}
 
-	if p.getCurType() == TOK_INT {
-		p.getNextToken()
-	} else {
-		return nil
+	if _, isDeclared := p.VariableTable[vdecl.Name]; isDeclared {
+		p.errorf(index, "Variable: redeclaration of %s", vdecl.Name)
+		return
 	}
 
-	if p.getCurType() == TOK_IDENTIFIER {
-		name = p.getCurString()
-		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
+	p.VariableTable[vdecl.Name] = vdecl
+	funcStmt.VariableDecls = append(funcStmt.VariableDecls, vdecl)
+}
+
+func (p *Parser) visitLocalDeclaration() *VariableDeclAST {
+	debug("visitLocalDeclaration")
+
+	storage, _, name, pos, varType := p.visitDeclarationHead()
+
+	if varType == nil {
 		return nil
 	}
 
-	if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == ";" {
+	return p.visitVariableDeclaration(storage, name, pos, varType)
+}
+
+// visitVariableDeclaration parses the rest of the declaration of the
+// variable name, declared at pos, after its declarator: an optional
+// initializer and the ';'.
+func (p *Parser) visitVariableDeclaration(storage StorageClass, name string, pos Pos, varType *TypeAST) *VariableDeclAST {
+	debug("visitVariableDeclaration")
+
+	var init AST
+
+	if p.getCurType() == TOK_ASSIGN {
 		p.getNextToken()
-	} else {
-		p.applyTokenIndex(bkup)
+
+		if init = p.visitAssignmentExpression(); init == nil {
+			return nil
+		}
+	}
+
+	if p.getCurType() != TOK_SEMICOLON {
+		p.expect("';' after declaration")
 		return nil
 	}
 
-	return &VariableDeclAST{Name: name, BaseAST: &BaseAST{VariableDeclID}}
+	p.getNextToken()
+
+	return &VariableDeclAST{
+		Name:    name,
+		VarType: varType,
+		Storage: storage,
+		Init:    init,
+		BaseAST: &BaseAST{VariableDeclID, pos}}
 }
 
-func (p *Parser) visitStatement() (result AST) {
+// visitStatement parses a statement, telling the kinds apart by their first
+// token.
+func (p *Parser) visitStatement() AST {
 	debug("visitStatement")
 
-	bkup := p.getCurIndex()
+	if p.getCurType() == TOK_RETURN {
+		return p.visitJumpStatement()
+	}
 
-	for {
-		if expr := p.visitExpressionStatement(); expr != nil {
-			result = expr
-			return
-		} else if jump := p.visitJumpStatement(); jump != nil {
-			result = jump
-			return
-		} else {
-			p.applyTokenIndex(bkup)
-			return nil
-		}
+	if p.getCurType() == TOK_IDENTIFIER && p.getCurString() == "assert" && !p.isVariableName("assert") {
+		return p.visitAssertStatement()
 	}
 
-	return
+	return p.visitExpressionStatement()
 }
 
 func (p *Parser) visitExpressionStatement() AST {
 	debug("visitExpressionStatement")
 
-	if p.getCurString() == ";" {
+	if p.getCurType() == TOK_SEMICOLON {
+		pos := p.curPos()
 		p.getNextToken()
-		return &NullExprAST{&BaseAST{NullExprID}}
+		return &NullExprAST{&BaseAST{NullExprID, pos}}
 	} else if assignExpr := p.visitAssignmentExpression(); assignExpr != nil {
-		if p.getCurString() == ";" {
+		if p.getCurType() == TOK_SEMICOLON {
 			p.getNextToken()
 			return assignExpr
 		}
+
+		p.expect("';' after expression")
 	}
 
 	return nil
 }
 
+// visitAssignmentExpression parses a whole expression, assignments
+// included.
 func (p *Parser) visitAssignmentExpression() AST {
 	debug("visitAssignmentExpression")
 
-	bkup := p.getCurIndex()
+	return p.visitBinaryExpression(1)
+}
 
-	if p.getCurType() == TOK_IDENTIFIER {
-		found := false
+// visitBinaryExpression parses an expression by precedence climbing: a unary
+// expression followed by binary operators that bind at least as tightly as
+// minPrec, each taking as its right operand what binds more tightly than
+// itself, or as tightly for a right-associative one. Only an identifier can
+// be assigned to, so "=" ends the expression after anything else; the
+// Checker reports one that does not name a variable.
+func (p *Parser) visitBinaryExpression(minPrec int) AST {
+	debug("visitBinaryExpression")
 
-		for _, availableVdecl := range p.VariableTable {
-			if availableVdecl == p.getCurString() {
-				found = true
-			}
+	lhs := p.visitUnaryExpression()
+
+	if lhs == nil {
+		return nil
+	}
+
+	for {
+		op := binaryOperators[p.getCurType()]
+
+		if op == nil || op.Prec < minPrec || (op.Op == "=" && !isIdentifier(lhs)) {
+			return lhs
 		}
 
-		if found {
-			lhs := &VariableAST{p.getCurString(), &BaseAST{VariableID}}
-			p.getNextToken()
+		pos := p.curPos()
+		p.getNextToken()
 
-			if p.getCurType() == TOK_SYMBOL && p.getCurString() == "=" {
-				p.getNextToken()
+		rhsPrec := op.Prec + 1
 
-				if rhs := p.visitAdditiveExpression(nil); rhs != nil {
-					return &BinaryExprAST{"=", lhs, rhs, &BaseAST{BinaryExprID}}
-				} else {
-					p.applyTokenIndex(bkup)
-				}
-			} else {
-				p.applyTokenIndex(bkup)
-			}
-		} else {
-			p.applyTokenIndex(bkup)
+		if op.Assoc == Assoc_right {
+			rhsPrec = op.Prec
 		}
-	}
 
-	addExpr := p.visitAdditiveExpression(nil)
+		rhs := p.visitBinaryExpression(rhsPrec)
 
-	if addExpr != nil {
-		return addExpr
-	}
+		if rhs == nil {
+			return nil
+		}
 
-	return nil
+		lhs = &BinaryExprAST{op.Op, lhs, rhs, &BaseAST{BinaryExprID, pos}}
+	}
 }
 
-func (p *Parser) visitAdditiveExpression(lhs AST) AST {
-	debug("visitAdditiveExpression")
+// visitUnaryExpression parses a postfix expression after any number of
+// unary operators. The negation of a number is folded into the number, so
+// that it is still a constant.
+func (p *Parser) visitUnaryExpression() AST {
+	debug("visitUnaryExpression")
 
-	bkup := p.getCurIndex()
+	op := unaryOperators[p.getCurType()]
 
-	if lhs == nil {
-		lhs = p.visitMultiplicativeExpression(nil)
+	if op == nil {
+		return p.visitPostfixExpression()
 	}
 
-	if lhs == nil {
+	pos := p.curPos()
+	p.getNextToken()
+
+	operand := p.visitBinaryExpression(op.Prec)
+
+	if operand == nil {
 		return nil
 	}
 
-	if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == "+" {
-		p.getNextToken()
+	if number, isNumber := operand.(*NumberAST); isNumber && op.Op == "-" {
+		return &NumberAST{-number.Val, &BaseAST{NumberID, pos}}
+	}
 
-		rhs := p.visitMultiplicativeExpression(nil)
+	return &UnaryExprAST{op.Op, operand, &BaseAST{UnaryExprID, pos}}
+}
 
-		if rhs != nil {
-			return p.visitMultiplicativeExpression(
-				&BinaryExprAST{"+", lhs, rhs, &BaseAST{BinaryExprID}})
-		} else {
-			p.applyTokenIndex(bkup)
-			return nil
-		}
+// visitPostfixExpression parses calls. Callees are resolved by the Checker
+// once the whole translation unit is known, so a function may be called
+// before it is declared.
+func (p *Parser) visitPostfixExpression() (result AST) {
+	debug("visitPostfixExpression")
+
+	if result = p.visitPrimaryExpression(); result == nil {
+		return nil
 	}
 
-	if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == "-" {
-		p.getNextToken()
+	for p.getCurType() == TOK_LPAREN {
+		args := p.visitArgumentList()
 
-		rhs := p.visitMultiplicativeExpression(nil)
+		if args == nil {
+			return nil
+		}
 
-		if rhs != nil {
-			return p.visitMultiplicativeExpression(
-				&BinaryExprAST{"-", lhs, rhs, &BaseAST{BinaryExprID}})
+		if ref, isRef := result.(*FunctionRefAST); isRef {
+			result = &CallExprAST{Callee: ref.Name, Args: args, BaseAST: &BaseAST{CallExprID, ref.Pos}}
 		} else {
-			p.applyTokenIndex(bkup)
-			return nil
+			result = &CallExprAST{Args: args, Fn: result, BaseAST: &BaseAST{CallExprID, result.GetPos()}}
 		}
 	}
 
-	return lhs
+	return
 }
 
-func (p *Parser) visitMultiplicativeExpression(lhs AST) AST {
-	debug("visitMultiplicativeExpression")
+// visitArgumentList parses a parenthesized argument list. It returns nil
+// when the list is malformed.
+func (p *Parser) visitArgumentList() []AST {
+	debug("visitArgumentList")
 
-	bkup := p.getCurIndex()
+	args := []AST{}
 
-	if lhs == nil {
-		lhs = p.visitPostfixExpression()
-	}
+	p.getNextToken()
 
-	if lhs == nil {
-		return nil
-	}
-
-	if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == "*" {
-		p.getNextToken()
-
-		rhs := p.visitPostfixExpression()
+	for p.getCurType() != TOK_RPAREN {
+		if len(args) > 0 {
+			if p.getCurType() != TOK_COMMA {
+				p.expect("')'")
+				return nil
+			}
 
-		if rhs != nil {
-			return p.visitMultiplicativeExpression(
-				&BinaryExprAST{"*", lhs, rhs, &BaseAST{BinaryExprID}})
-		} else {
-			p.applyTokenIndex(bkup)
-			return nil
+			p.getNextToken()
 		}
-	}
-
-	if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == "/" {
-		p.getNextToken()
 
-		rhs := p.visitPostfixExpression()
+		assignExpr := p.visitAssignmentExpression()
 
-		if rhs != nil {
-			return p.visitMultiplicativeExpression(
-				&BinaryExprAST{"/", lhs, rhs, &BaseAST{BinaryExprID}})
-		} else {
-			p.applyTokenIndex(bkup)
+		if assignExpr == nil {
 			return nil
 		}
+
+		args = append(args, assignExpr)
 	}
 
-	return lhs
-}
+	p.getNextToken()
 
-func (p *Parser) visitPostfixExpression() (result AST) {
-	debug("visitPostfixExpression")
+	return args
+}
 
-	var paramNum int
-	var isInTable bool
+func (p *Parser) visitPrimaryExpression() AST {
+	debug("visitPrimaryExpression")
 
-	bkup := p.getCurIndex()
+	pos := p.curPos()
 
 	if p.getCurType() == TOK_IDENTIFIER {
-		callee := p.getCurString()
+		name := p.getCurString()
 		p.getNextToken()
 
-		if paramNum, isInTable = p.PrototypeTable[callee]; !isInTable {
-			if paramNum, isInTable = p.FunctionTable[callee]; !isInTable {
-				p.applyTokenIndex(bkup)
-
-				if priExpr := p.visitPrimaryExpression(); priExpr != nil {
-					result = priExpr
-				}
+		// any other identifier names a function, possibly one that is
+		// declared later
+		if p.isVariableName(name) {
+			return &VariableAST{name, &BaseAST{VariableID, pos}}
+		} else {
+			return &FunctionRefAST{name, &BaseAST{FunctionRefID, pos}}
+		}
+	} else if p.getCurType() == TOK_AMPERSAND {
+		p.getNextToken()
 
-				return
-			}
+		if p.getCurType() == TOK_IDENTIFIER && !p.isVariableName(p.getCurString()) {
+			name := p.getCurString()
+			p.getNextToken()
+			return &FunctionRefAST{name, &BaseAST{FunctionRefID, pos}}
 		}
 
-		if p.getCurType() != TOK_SYMBOL ||
-			p.getCurString() != "(" {
-			p.applyTokenIndex(bkup)
+		p.expect("function name")
+		return nil
+	} else if p.getCurType() == TOK_LPAREN {
+		p.getNextToken()
 
-			if priExpr := p.visitPrimaryExpression(); priExpr != nil {
-				result = priExpr
+		if expr := p.visitAssignmentExpression(); expr != nil {
+			if p.getCurType() == TOK_RPAREN {
+				p.getNextToken()
+				return expr
 			}
 
-			return
+			p.expect("')'")
 		}
 
+		return nil
+	} else if p.getCurType() == TOK_DIGIT {
+		val := p.getCurNumVal()
 		p.getNextToken()
+		return &NumberAST{val, &BaseAST{NumberID, pos}}
+	} else if p.getCurType() == TOK_STRING {
+		if val, ok := unquoteString(p.getCurString()); ok {
+			p.getNextToken()
+			return &StringAST{val, &BaseAST{StringID, pos}}
+		}
 
-		args := []AST{}
+		return nil
+	}
 
-		for {
-			if assignExpr := p.visitAssignmentExpression(); assignExpr != nil {
-				args = append(args, assignExpr)
+	p.expect("expression")
 
-				if p.getCurType() == TOK_SYMBOL && p.getCurString() == "," {
-					p.getNextToken()
-				} else {
-					break
-				}
-			}
-		}
+	return nil
+}
 
-		if len(args) != paramNum {
-			p.applyTokenIndex(bkup)
-			return nil
-		}
+// isIdentifier reports whether expr is a bare name, of a variable or not.
+func isIdentifier(expr AST) bool {
+	return expr.GetID() == VariableID || expr.GetID() == FunctionRefID
+}
 
-		if p.getCurType() == TOK_SYMBOL && p.getCurString() == ")" {
-			p.getNextToken()
-			result = &CallExprAST{callee, args, &BaseAST{CallExprID}}
-		} else {
-			p.applyTokenIndex(bkup)
-		}
+func (p *Parser) isVariableName(name string) bool {
+	if _, isLocal := p.VariableTable[name]; isLocal {
+		return true
 	}
 
-	if result == nil {
-		if priExpr := p.visitPrimaryExpression(); priExpr != nil {
-			result = priExpr
-			return
-		}
-	}
+	_, isGlobal := p.GlobalTable[name]
 
-	return
+	return isGlobal
 }
 
-func (p *Parser) visitPrimaryExpression() AST {
-	debug("visitPrimaryExpression")
+// visitAssertStatement parses the builtin "assert(expr);". A disabled assert
+// becomes an empty statement, leaving its expression unevaluated.
+func (p *Parser) visitAssertStatement() AST {
+	debug("visitAssertStatement")
 
-	bkup := p.getCurIndex()
+	token := p.getToken()
+	p.getNextToken()
 
-	if p.getCurType() == TOK_IDENTIFIER {
-		found := false
+	if p.getCurType() != TOK_LPAREN {
+		p.expect("'('")
+		return nil
+	}
 
-		for _, availableVdecl := range p.VariableTable {
-			if availableVdecl == p.getCurString() {
-				found = true
-			}
-		}
+	p.getNextToken()
+	start := p.getCurIndex()
 
-		if found {
-			name := p.getCurString()
-			p.getNextToken()
-			return &VariableAST{name, &BaseAST{VariableID}}
-		} else {
-			p.applyTokenIndex(bkup)
-			return nil
-		}
-	} else if p.getCurType() == TOK_DIGIT {
-		val := p.getCurNumVal()
-		p.getNextToken()
-		return &NumberAST{val, &BaseAST{NumberID}}
-	} else if p.getCurType() == TOK_SYMBOL &&
-		p.getCurString() == "-" {
-		p.getNextToken()
-		if p.getCurType() == TOK_DIGIT {
-			val := p.getCurNumVal()
+	if expr := p.visitAssignmentExpression(); expr != nil {
+		end := p.getCurIndex()
+
+		if p.getCurType() == TOK_RPAREN {
 			p.getNextToken()
-			return &NumberAST{-val, &BaseAST{NumberID}}
+
+			if p.getCurType() == TOK_SEMICOLON {
+				p.getNextToken()
+
+				if p.NoAssert {
+					return &NullExprAST{&BaseAST{NullExprID, token.Pos}}
+				}
+
+				position := p.position(&token)
+
+				return &AssertStmtAST{expr, position.Filename, position.Line, p.fileSet().Text(p.tokenAt(start).Pos, p.tokenAt(end-1).End), &BaseAST{AssertStmtID, token.Pos}}
+			}
+
+			p.expect("';' after assert")
 		} else {
-			p.applyTokenIndex(bkup)
-			return nil
+			p.expect("')'")
 		}
 	}
 
@@ -604,26 +1175,27 @@ func (p *Parser) visitPrimaryExpression() AST {
 func (p *Parser) visitJumpStatement() AST {
 	debug("visitJumpStatement")
 
-	bkup := p.getCurIndex()
-
-	if p.getCurType() == TOK_RETURN {
-		p.getNextToken()
+	pos := p.curPos()
+	p.getNextToken()
 
-		if assignExpr := p.visitAssignmentExpression(); assignExpr != nil {
-			if p.getCurType() == TOK_SYMBOL &&
-				p.getCurString() == ";" {
-				p.getNextToken()
-				return &JumpStmtAST{assignExpr, &BaseAST{JumpStmtID}}
-			}
+	if assignExpr := p.visitAssignmentExpression(); assignExpr != nil {
+		if p.getCurType() == TOK_SEMICOLON {
+			p.getNextToken()
+			return &JumpStmtAST{assignExpr, &BaseAST{JumpStmtID, pos}}
 		}
+
+		p.expect("';' after return statement")
 	}
 
-	p.applyTokenIndex(bkup)
 	return nil
 }
 
+// debugging is read once, as looking DEBUG up on every visit would cost
+// more than parsing.
+var debugging = os.Getenv("DEBUG") != ""
+
 func debug(msg string) {
-	if os.Getenv("DEBUG") != "" {
+	if debugging {
 		fmt.Println(msg)
 	}
 }
@@ -0,0 +1,524 @@
+package frontend
+
+import (
+	"fmt"
+	"github.com/coocood/assrt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseString(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tu, err := ParseString("mem.xxx", "int add(int a, int b) {\n  return a + b;\n}\n", &Options{})
+
+	assert.MustNil(err)
+	assert.MustEqual(1, len(tu.Functions))
+	assert.Equal("add", tu.Functions[0].Proto.Name)
+
+	_, err = ParseString("mem.xxx", "int f(void) {\n  return 1 @ 2;\n}\n", &Options{})
+
+	assert.MustNotNil(err)
+	list, ok := err.(DiagnosticList)
+	assert.MustTrue(ok)
+	assert.Equal(1, len(list))
+	assert.Equal("mem.xxx:2:12: error: invalid character '@'", list[0].Error())
+
+	_, err = Parse("mem.xxx", strings.NewReader("int f(void) {\n  return;\n}\n"), &Options{})
+
+	assert.NotNil(err)
+
+	// nil options are the defaults
+	src := "int main(void) {\n  return 0;\n}\n"
+	_, err = ParseString("x", src, nil)
+	assert.Nil(err)
+	_, err = ParseStream("x", strings.NewReader(src), nil)
+	assert.Nil(err)
+	tokens, err := LexString("x", src, nil)
+	assert.Nil(err)
+	assert.True(NewParserFromTokens(tokens, nil).DoParse())
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	errorOf := func(src string) string {
+		_, err := ParseString("t.xxx", src, &Options{})
+		assert.MustNotNil(err)
+
+		list, ok := err.(DiagnosticList)
+		assert.MustTrue(ok)
+
+		return list.Errors()[0].Error()
+	}
+
+	assert.Equal("t.xxx:3:1: error: expected ';' after expression, found '}'",
+		errorOf("int main(void) {\n  printnum(1)\n}\n"))
+	assert.Equal("t.xxx:2:10: error: expected expression, found ';'",
+		errorOf("int main(void) {\n  return ;\n}\n"))
+	assert.Equal("t.xxx:2:1: error: expected ';' or '{', found 'int'",
+		errorOf("int f(void)\nint g(void);\n"))
+	assert.Equal("t.xxx:2:1: error: Function: f is redefined",
+		errorOf("int f(void) { return 1; }\nint f(void) { return 2; }\n"))
+	assert.Equal("t.xxx:3:1: error: Function: main must end with a return statement",
+		errorOf("int main(void) {\n  printnum(1);\n}\n"))
+
+	tokens, err := LexString("t.xxx", "int main(void) {\n  const int *p;\n  int *q;\n  q = p;\n  return 0;\n}\n", &Options{})
+	assert.MustNil(err)
+
+	parser := NewParserFromTokens(tokens, &Options{})
+	assert.MustTrue(parser.DoParse())
+	assert.Equal(1, len(parser.Diagnostics))
+	assert.Equal(Severity_warning, parser.Diagnostics[0].Severity)
+	assert.Equal("t.xxx:4:7: warning: assignment to q in function main discards const qualifier from pointer target type",
+		parser.Diagnostics[0].Error())
+
+	// the checker reports at the node that is wrong
+	assert.Equal("t.xxx:3:5: error: Variable: invalid pointer operand to binary + in function main",
+		errorOf("int main(void) {\n  int *p;\n  p + 1;\n  return 0;\n}\n"))
+	assert.Equal("t.xxx:3:10: error: Variable: invalid pointer operand to unary - in function main",
+		errorOf("int main(void) {\n  int *p;\n  return -p;\n}\n"))
+	assert.Equal("t.xxx:1:10: error: Variable: initialization of p mixes pointer and integer",
+		errorOf("int *p = 2;\n"))
+	assert.Equal("t.xxx:3:11: error: Function: call to undeclared function g in function main",
+		errorOf("int main(void) {\n  int x;\n  x = 1 + g(x);\n  return x;\n}\n"))
+}
+
+func TestCheckMain(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	for _, test := range []struct {
+		src         string
+		diagnostics string
+	}{
+		{"int main(void) {\n  return 0;\n}\n", "no errors"},
+		{"int main(int argc, char **argv) {\n  return argc;\n}\n", "no errors"},
+		{"int main(int, char **);\nint main(int argc, char **argv) {\n  return argc;\n}\n", "no errors"},
+		{"int f(void);\nstatic int main(void) {\n  return 0;\n}\n", "t.xxx:2:12: error: Function: main must not be static"},
+		{"int f(void) {\n  return 0;\n}\n", "t.xxx: error: Function: main is not defined"},
+		{"int main(void);\n", "t.xxx: error: Function: main is not defined"},
+		{"int main(int argc) {\n  return argc;\n}\n",
+			"t.xxx:1:5: error: Function: main must be declared as int main(void) or int main(int argc, char **argv)"},
+		{"int main(int argc, char *argv) {\n  return argc;\n}\n",
+			"t.xxx:1:5: error: Function: main must be declared as int main(void) or int main(int argc, char **argv)"},
+		{"int main(char **argv, int argc) {\n  return argc;\n}\n",
+			"t.xxx:1:5: error: Function: main must be declared as int main(void) or int main(int argc, char **argv)"},
+		{"int main(int argc, char **argv, ...) {\n  return argc;\n}\n",
+			"t.xxx:1:5: error: Function: main must be declared as int main(void) or int main(int argc, char **argv)"},
+	} {
+		tokens, err := LexString("t.xxx", test.src, &Options{})
+		assert.MustNil(err)
+
+		parser := NewParserFromTokens(tokens, &Options{})
+		assert.MustTrue(parser.DoParse(), test.src)
+		assert.Equal(test.diagnostics == "no errors", parser.CheckMain(), test.src)
+		assert.Equal(test.diagnostics, parser.Diagnostics.Error(), test.src)
+	}
+}
+
+func diagnosticsOf(t *testing.T, src string, opts *Options) []string {
+	tokens, err := LexString("t.xxx", src, opts)
+	assrt.NewAssert(t).MustNil(err)
+
+	parser := NewParserFromTokens(tokens, opts)
+	parser.DoParse()
+
+	var diagnostics []string
+
+	for _, d := range parser.Diagnostics {
+		diagnostics = append(diagnostics, d.Error())
+	}
+
+	return diagnostics
+}
+
+// diagnosticTest is a source and the diagnostics parsing it gives, nil if
+// there are none.
+type diagnosticTest struct {
+	src         string
+	diagnostics []string
+}
+
+func checkDiagnostics(t *testing.T, tests []diagnosticTest) {
+	assert := assrt.NewAssert(t)
+
+	for _, test := range tests {
+		assert.Equal(test.diagnostics, diagnosticsOf(t, test.src, &Options{}), test.src)
+	}
+}
+
+func TestParseVariadicCalls(t *testing.T) {
+	checkDiagnostics(t, []diagnosticTest{
+		{"int printf(char *fmt, ...);\nint main(void) {\n  printf(\"%d %d\\n\", 1, 2);\n  return printf(\"x\");\n}\n", nil},
+		{"int f(int a, ...) {\n  return a;\n}\n", nil},
+		{"int printf(char *fmt, ...);\nint main(void) {\n  return printf();\n}\n",
+			[]string{"t.xxx:3:10: error: Function: printf expects 1 arguments, but 0 given in function main"}},
+		{"int putchar(int c);\nint main(void) {\n  return putchar(1, 2);\n}\n",
+			[]string{"t.xxx:3:10: error: Function: putchar expects 1 arguments, but 2 given in function main"}},
+		{"int printf(char *fmt, ...);\nint main(void) {\n  return printf(1);\n}\n",
+			[]string{"t.xxx:3:17: error: Variable: passing argument 1 of printf in function main mixes pointer and integer"}},
+		{"int f(...);\n", []string{"t.xxx:1:7: error: expected type, found '...'"}},
+		{"int f(int a, ...);\nint f(int a);\n", []string{"t.xxx:2:1: error: Function: conflicting types for f"}},
+	})
+}
+
+func TestParseLinkage(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	checkDiagnostics(t, []diagnosticTest{
+		{"static int f(int a);\nint f(int a) {\n  return a;\n}\n", nil},
+		{"extern int f(int a);\nint f(int a) {\n  return a;\n}\n", nil},
+		{"static int g;\nextern int g;\n", nil},
+		{"extern int g;\nint g = 1;\n", nil},
+		{"int main(void) {\n  static int n = 1;\n  return n;\n}\n", nil},
+		{"int f(int a);\nstatic int f(int a) {\n  return a;\n}\n",
+			[]string{"t.xxx:2:1: error: Function: static declaration of f follows non-static declaration"}},
+		{"int g;\nstatic int g;\n", []string{"t.xxx:2:1: error: Variable: g is redeclared with conflicting storage class"}},
+		{"static extern int g;\n", []string{"t.xxx:1:1: error: multiple storage classes in declaration"}},
+		{"int g;\nint g(void);\n", []string{"t.xxx:2:1: error: Function: g is redeclared as a different kind of symbol"}},
+		{"int main(void) {\n  extern int n;\n  return n;\n}\n",
+			[]string{"t.xxx:2:3: error: Variable: extern is not supported for local variable n"}},
+		{"int main(void) {\n  int m;\n  static int n = m;\n  return n;\n}\n",
+			[]string{"t.xxx:3:3: error: Variable: initializer of static n is not a constant"}},
+	})
+
+	// a definition without "static" keeps the linkage of a static prototype
+	tokens, err := LexString("t.xxx", "static int f(int a);\nint f(int a) {\n  return a;\n}\n", &Options{})
+	assert.MustNil(err)
+
+	parser := NewParserFromTokens(tokens, &Options{})
+	assert.MustTrue(parser.DoParse())
+	assert.Equal(Storage_static, parser.LinkageTable["f"])
+}
+
+func TestParseConst(t *testing.T) {
+	checkDiagnostics(t, []diagnosticTest{
+		{"int main(void) {\n  const int x = 1;\n  int y;\n  y = x;\n  return y;\n}\n", nil},
+		{"int main(void) {\n  const char *s;\n  char *t;\n  s = t;\n  s = \"a\";\n  return 0;\n}\n", nil},
+		{"const int g = 1;\nint main(void) {\n  g = 2;\n  return g;\n}\n",
+			[]string{"t.xxx:3:5: error: Variable: assignment of read-only variable g in function main"}},
+		{"int f(const int a) {\n  a = 1;\n  return a;\n}\n",
+			[]string{"t.xxx:2:5: error: Variable: assignment of read-only variable a in function f"}},
+		{"int main(void) {\n  const int x = 1;\n  return x = 2;\n}\n",
+			[]string{"t.xxx:3:12: error: Variable: assignment of read-only variable x in function main"}},
+		{"int main(void) {\n  char * const p = \"a\";\n  p = \"b\";\n  return 0;\n}\n",
+			[]string{"t.xxx:3:5: error: Variable: assignment of read-only variable p in function main"}},
+		{"int main(void) {\n  const char *s;\n  char *t;\n  t = s;\n  return 0;\n}\n",
+			[]string{"t.xxx:4:7: warning: assignment to t in function main discards const qualifier from pointer target type"}},
+		{"int main(void) {\n  const char *s = \"a\";\n  char *t = s;\n  return 0;\n}\n",
+			[]string{"t.xxx:3:13: warning: initialization of t in function main discards const qualifier from pointer target type"}},
+		{"int f(char *s);\nint main(void) {\n  const char *s;\n  return f(s);\n}\n",
+			[]string{"t.xxx:4:12: warning: passing argument 1 of f in function main discards const qualifier from pointer target type"}},
+	})
+}
+
+func TestParseFunctionPointers(t *testing.T) {
+	add := "int add(int a, int b) {\n  return a + b;\n}\n"
+
+	checkDiagnostics(t, []diagnosticTest{
+		{add + "int main(void) {\n  int (*op)(int, int) = add;\n  return op(1, 2);\n}\n", nil},
+		{add + "int main(void) {\n  int (*op)(int, int) = &add;\n  return (*op)(1, 2);\n}\n", nil},
+		{add + "int (*g)(int, int) = &add;\nint main(void) {\n  return g(1, 2);\n}\n", nil},
+		{"int apply(int (*f)(int), int x) {\n  return f(x);\n}\n", nil},
+		{add + "int main(void) {\n  int (*op)(int, int) = add;\n  return op(1);\n}\n",
+			[]string{"t.xxx:6:10: error: Function: function pointer expects 2 arguments, but 1 given in function main"}},
+		{add + "int main(void) {\n  int (*op)(int, int) = &add;\n  return (*op)(1, 2, 3);\n}\n",
+			[]string{"t.xxx:6:11: error: Function: function pointer expects 2 arguments, but 3 given in function main"}},
+		{"int neg(int a) {\n  return -a;\n}\nint main(void) {\n  int (*op)(int, int) = &neg;\n  return 0;\n}\n",
+			[]string{"t.xxx:5:25: error: Variable: incompatible pointer types in initialization of op in function main"}},
+		{"int main(void) {\n  int x;\n  return x(1);\n}\n",
+			[]string{"t.xxx:3:10: error: Function: called object is not a function in function main"}},
+	})
+}
+
+func TestParseCallsToLaterFunctions(t *testing.T) {
+	f := "int f(int a) {\n  return a;\n}\n"
+
+	checkDiagnostics(t, []diagnosticTest{
+		{"int main(void) {\n  return f(1);\n}\n" + f, nil},
+		{"int even(int n) {\n  return odd(n - 1);\n}\nint odd(int n) {\n  return even(n - 1);\n}\n", nil},
+		{"int main(void) {\n  int (*p)(int) = &f;\n  return p(1);\n}\n" + f, nil},
+		{"int main(void) {\n  return f(1, 2);\n}\n" + f,
+			[]string{"t.xxx:2:10: error: Function: f expects 1 arguments, but 2 given in function main"}},
+		{"int main(void) {\n  return h(1);\n}\n" + f,
+			[]string{"t.xxx:2:10: error: Function: call to undeclared function h in function main"}},
+		{"int main(void) {\n  return f(1);\n}\nint f;\n",
+			[]string{"t.xxx:2:10: error: Function: call to undeclared function f in function main"}},
+	})
+
+	// a name that is neither a variable nor a function is undeclared
+	// wherever it appears in an expression
+	checkDiagnostics(t, []diagnosticTest{
+		{"int main(void) {\n  x = 1;\n  return 0;\n}\n",
+			[]string{"t.xxx:2:3: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  int y = 1;\n  y = x = 2;\n  return y;\n}\n",
+			[]string{"t.xxx:3:7: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  int y = x;\n  return y;\n}\n",
+			[]string{"t.xxx:2:11: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  return x + 1;\n}\n",
+			[]string{"t.xxx:2:10: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  return f(x);\n}\n" + f,
+			[]string{"t.xxx:2:12: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  char *s;\n  s = x;\n  return 0;\n}\n",
+			[]string{"t.xxx:3:7: error: Variable: undeclared identifier x in function main"}},
+		{"int main(void) {\n  int (*p)(int) = &x;\n  return 0;\n}\n",
+			[]string{"t.xxx:2:19: error: Variable: undeclared identifier x in function main"}},
+		{"int g = x;\n", []string{"t.xxx:1:9: error: Variable: undeclared identifier x"}},
+		{"int main(void) {\n  f = 1;\n  return 0;\n}\n" + f,
+			[]string{"t.xxx:2:5: error: Variable: assignment to function f in function main"}},
+	})
+}
+
+func TestParseParameterLists(t *testing.T) {
+	checkDiagnostics(t, []diagnosticTest{
+		{"int f(int, int);\nint f(int a, int b) {\n  return a + b;\n}\n", nil},
+		{"int f(void);\nint f(void) {\n  return 1;\n}\n", nil},
+		{"int f(char *, int (*)(int));\n", nil},
+		{"int f(int, int);\nint f(int a) {\n  return a;\n}\n", []string{"t.xxx:2:1: error: Function: conflicting types for f"}},
+		{"int f(int, int);\nint f(int a, char *b) {\n  return a;\n}\n", []string{"t.xxx:2:1: error: Function: conflicting types for f"}},
+		{"int f(int a, int) {\n  return a;\n}\n", []string{"t.xxx:1:1: error: Function: parameter name omitted in definition of f"}},
+		{"int f(void, int);\n", []string{"t.xxx:1:11: error: expected ')', found ','"}},
+		{"int f(void x);\n", []string{"t.xxx:1:12: error: expected ')', found 'x'"}},
+		{"int f(int a, int a);\n", []string{"t.xxx:1:18: error: Function: redefinition of parameter a"}},
+		{"int f(void);\nint main(void) {\n  return f(1);\n}\n",
+			[]string{"t.xxx:3:10: error: Function: f expects 0 arguments, but 1 given in function main"}},
+	})
+}
+
+func TestParseAssert(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	// the text is sliced from the source, so it keeps its spacing, and a
+	// macro expanded in it appears as invoked
+	for src, text := range map[string]string{
+		"x":                  "x",
+		"x*2+-1":             "x*2+-1",
+		" (x - 1)/ 2 ":       "(x - 1)/ 2",
+		"printnum(-x)":       "printnum(-x)",
+		"x = - 1":            "x = - 1",
+		"x /* c */\n    + N": "x /* c */\n    + N",
+		"TWICE(x, N)":        "TWICE(x, N)",
+		"TWICE( x , N )":     "TWICE( x , N )",
+	} {
+		tu, err := ParseString("t.xxx", "#define N 10\n#define TWICE(a, b) (a + b) * 2\nint main(void) {\n  int x;\n  assert("+
+			src+");\n  return 0;\n}\n", &Options{})
+		assert.MustNil(err, src)
+
+		stmt, ok := tu.Functions[0].Body.StmtLists[0].(*AssertStmtAST)
+		assert.MustTrue(ok, src)
+		assert.Equal(text, stmt.Text)
+		assert.Equal("t.xxx", stmt.File)
+		assert.Equal(5, stmt.Line)
+	}
+
+	// asserts are compiled away with NDEBUG or -no-assert
+	src := "int main(void) {\n  assert(0);\n  return 0;\n}\n"
+
+	for _, opts := range []*Options{{NoAssert: true}, {Defines: map[string]string{"NDEBUG": ""}}} {
+		tu, err := ParseString("t.xxx", src, opts)
+		assert.MustNil(err)
+		assert.Equal(NullExprID, tu.Functions[0].Body.StmtLists[0].GetID())
+	}
+
+	checkDiagnostics(t, []diagnosticTest{
+		{"int main(void) {\n  assert(1;\n  return 0;\n}\n", []string{"t.xxx:2:11: error: expected ')', found ';'"}},
+		{"int main(void) {\n  assert(1)\n  return 0;\n}\n", []string{"t.xxx:3:3: error: expected ';' after assert, found 'return'"}},
+		{"int main(void) {\n  assert();\n  return 0;\n}\n", []string{"t.xxx:2:10: error: expected expression, found ')'"}},
+		{"int main(void) {\n  int assert;\n  assert = 1;\n  return assert;\n}\n", nil},
+	})
+}
+
+func TestParseRecovery(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	src := "int f(int a,, int b) {\n  return a;\n}\n" +
+		"int main(void) {\n  int x = 1\n  int y;\n  y = 1 +;\n  printnum(y)\n  return y;\n}\n" +
+		"int z = 1\nint w;\n"
+
+	tokens, err := LexString("t.xxx", src, &Options{})
+	assert.MustNil(err)
+
+	parser := NewParserFromTokens(tokens, &Options{})
+	assert.False(parser.DoParse())
+	assert.Equal(5, len(parser.Diagnostics))
+	assert.Equal("t.xxx:1:13: error: expected type, found ','", parser.Diagnostics[0].Error())
+	assert.Equal("t.xxx:6:3: error: expected ';' after declaration, found 'int'", parser.Diagnostics[1].Error())
+	assert.Equal("t.xxx:7:10: error: expected expression, found ';'", parser.Diagnostics[2].Error())
+	assert.Equal("t.xxx:9:3: error: expected ';' after expression, found 'return'", parser.Diagnostics[3].Error())
+	assert.Equal("t.xxx:12:1: error: expected ';' after declaration, found 'int'", parser.Diagnostics[4].Error())
+
+	// the broken statements are kept as error nodes
+	tu := parser.GetAST()
+	assert.MustEqual(1, len(tu.Functions))
+	body := tu.Functions[0].Body
+	assert.Equal(1, len(body.VariableDecls))
+	assert.MustEqual(4, len(body.StmtLists))
+	assert.Equal(ErrorID, body.StmtLists[0].GetID())
+	assert.Equal(ErrorID, body.StmtLists[1].GetID())
+	assert.Equal(ErrorID, body.StmtLists[2].GetID())
+	assert.Equal(JumpStmtID, body.StmtLists[3].GetID())
+	assert.Equal("expected expression, found ';'", body.StmtLists[1].(*ErrorAST).Msg)
+	assert.Equal([]string{"w"}, []string{tu.Variables[0].Name})
+
+	// so are the broken external declarations
+	assert.MustEqual(2, len(tu.Errors))
+	assert.Equal("expected type, found ','", tu.Errors[0].Msg)
+	assert.Equal(1, parser.position(&Token{Pos: tu.Errors[0].Pos}).Line)
+	assert.Equal("expected ';' after declaration, found 'int'", tu.Errors[1].Msg)
+	assert.Equal(11, parser.position(&Token{Pos: tu.Errors[1].Pos}).Line)
+
+	// recovery stops at the start of the line the error is at, and the
+	// statement there fails at the same token again
+	_, err = ParseString("t.xxx", "int main(void) {\n  int x =\n  = 1;\n  return x;\n}\n", &Options{})
+	assert.Equal("t.xxx:3:3: error: expected expression, found '='", err.Error())
+
+	_, err = ParseString("t.xxx", "int main(void) {\n  1 +;\n  2 +;\n  3 +;\n  return 0;\n}\n", &Options{MaxErrors: 2})
+	list := err.(DiagnosticList)
+	assert.MustEqual(3, len(list))
+	assert.Equal("t.xxx:4:6: error: too many errors, stopping now (limit 2)", list[2].Error())
+
+	// the error node keeps the message of the error it failed with, rather
+	// than that of the last diagnostic
+	tokens, err = LexString("t.xxx", "int main(void) {\n  1 +;\n  2 +;\n  return 0;\n}\n", &Options{})
+	assert.MustNil(err)
+
+	parser = NewParserFromTokens(tokens, &Options{MaxErrors: 1})
+	assert.False(parser.DoParse())
+	assert.Equal("t.xxx:3:6: error: too many errors, stopping now (limit 1)", parser.Diagnostics[1].Error())
+
+	tu = parser.GetAST()
+	assert.Equal(0, len(tu.Functions))
+	assert.MustEqual(1, len(tu.Errors))
+	assert.Equal("expected expression, found ';'", tu.Errors[0].Msg)
+}
+
+// Every prefix of a token set parses to an end, whether or not it keeps the
+// EOF token, and panic mode stops at the last token of a set without one.
+func TestParseTruncatedTokens(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	src := "int f(int a,, int b) {\n  return a\n}\nint main(void) {\n  int x = 1 +\n  return x;\n}\n"
+
+	tokens, err := LexString("t.xxx", src, &Options{})
+	assert.MustNil(err)
+
+	for i := 0; i <= len(tokens.Tokens); i++ {
+		prefix := &TokenSet{Tokens: tokens.Tokens[:i], FileSet: tokens.FileSet}
+		NewParserFromTokens(prefix, &Options{}).DoParse()
+	}
+
+	prefix := &TokenSet{Tokens: tokens.Tokens[:8], FileSet: tokens.FileSet}
+	parser := NewParserFromSource(prefix, &Options{})
+	parser.errorf(4, "broken")
+	parser.recover(4, 0, true)
+	assert.Equal(7, parser.getCurIndex())
+}
+
+func exprString(expr AST) string {
+	switch e := expr.(type) {
+	case *BinaryExprAST:
+		return "(" + exprString(e.LHS) + " " + e.Op + " " + exprString(e.RHS) + ")"
+	case *UnaryExprAST:
+		return "(" + e.Op + exprString(e.Operand) + ")"
+	case *VariableAST:
+		return e.Name
+	case *NumberAST:
+		return strconv.Itoa(e.Val)
+	}
+
+	return "?"
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	for src, expected := range map[string]string{
+		"1 + 2 + 3":         "((1 + 2) + 3)",
+		"a - b - c":         "((a - b) - c)",
+		"a / b * c":         "((a / b) * c)",
+		"a + b * c - d / a": "((a + (b * c)) - (d / a))",
+		"a - -b * -3":       "(a - ((-b) * -3))",
+		"a = b = c + 1":     "(a = (b = (c + 1)))",
+		"(a + b) * c":       "((a + b) * c)",
+	} {
+		tu, err := ParseString("t.xxx", "int f(int a, int b, int c, int d) {\n  return "+src+";\n}\n", &Options{})
+		assert.MustNil(err)
+		assert.Equal(expected, exprString(tu.Functions[0].Body.StmtLists[0].(*JumpStmtAST).Expr))
+	}
+
+	_, err := ParseString("t.xxx", "int f(int a) {\n  return a + 1 = 2;\n}\n", &Options{})
+	assert.Equal("t.xxx:2:16: error: expected ';' after return statement, found '='", err.Error())
+}
+
+// countingSource counts the tokens a parser steps over, so that reading a
+// token twice after backtracking shows.
+type countingSource struct {
+	*TokenSet
+	reads int
+}
+
+func (s *countingSource) getNextToken() bool {
+	if !s.TokenSet.getNextToken() {
+		return false
+	}
+
+	s.reads++
+
+	return true
+}
+
+// nestedSource returns a translation unit whose expressions and declarators
+// nest depth deep.
+func nestedSource(depth int) string {
+	return "extern int puts(const char *s);\n" +
+		"static int g = -1;\n" +
+		"int apply(int (*f)(" + strings.Repeat("int (*)(", depth) + "int" + strings.Repeat(")", depth) + "));\n" +
+		"int f(int a, char **argv) {\n" +
+		"  int (*p)(const char *) = &puts;\n" +
+		"  assert(" + strings.Repeat("(a + ", depth) + "1" + strings.Repeat(")", depth) + ");\n" +
+		"  a = " + strings.Repeat("printnum(", depth) + "a" + strings.Repeat(")", depth) + ";\n" +
+		"  a = " + strings.Repeat("-a * ", depth) + "g;\n" +
+		"  a = " + strings.Repeat("a = ", depth) + "(*p)(\"x\");\n" +
+		"  return " + strings.Repeat("a - ", depth) + "a / 2;\n" +
+		"}\n"
+}
+
+func TestParseWithoutBacktracking(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	for _, src := range []string{nestedSource(1), nestedSource(50), generateSource(50)} {
+		tokens, err := LexString("t.xxx", src, &Options{})
+		assert.MustNil(err)
+
+		source := &countingSource{TokenSet: tokens}
+		parser := NewParserFromSource(source, &Options{})
+		assert.MustTrue(parser.DoParse())
+		assert.Equal(len(tokens.Tokens)-1, source.reads)
+	}
+}
+
+// BenchmarkParseNested parses ever more deeply nested expressions. The time
+// per token stays the same, as the parser never backtracks.
+func BenchmarkParseNested(b *testing.B) {
+	for _, depth := range []int{10, 100, 1000, 10000} {
+		tokens, err := LexString("t.xxx", nestedSource(depth), &Options{})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprint("depth=", depth), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				tokens.CurIndex = 0
+
+				if !NewParserFromTokens(tokens, &Options{}).DoParse() {
+					b.Fatal("parse failed")
+				}
+			}
+
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(tokens.Tokens)), "ns/token")
+		})
+	}
+}
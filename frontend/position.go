@@ -0,0 +1,209 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pos is a compact encoding of a source position within a FileSet, like
+// go/token.Pos: the base of the file plus a byte offset into it. The zero
+// value NoPos is not a position in any file.
+type Pos int
+
+const NoPos Pos = 0
+
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position is a Pos resolved to a file name, byte offset and 1-based line
+// and column. The column counts bytes.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// String returns "file:line:column", leaving out the parts that are unknown.
+func (pos Position) String() string {
+	s := pos.Filename
+
+	if pos.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+
+		s += fmt.Sprintf("%d", pos.Line)
+
+		if pos.Column != 0 {
+			s += fmt.Sprintf(":%d", pos.Column)
+		}
+	}
+
+	if s == "" {
+		s = "-"
+	}
+
+	return s
+}
+
+// File is a source file registered in a FileSet. It records where each line
+// starts so that offsets can be turned into lines and columns, and the
+// content of the files the lexer and the preprocessor read.
+type File struct {
+	name    string
+	base    int
+	size    int
+	lines   []int
+	content string
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Base() int {
+	return f.base
+}
+
+func (f *File) Size() int {
+	return f.size
+}
+
+func (f *File) LineCount() int {
+	return len(f.lines)
+}
+
+// SetLinesForContent records the line starts of content, which must be the
+// text the file was registered for. "\n", "\r\n" and a lone "\r" all end a
+// line.
+func (f *File) SetLinesForContent(content []byte) {
+	f.lines = lineStarts(string(content))
+}
+
+// setContent records the line starts of content like SetLinesForContent
+// and keeps it for FileSet.Text.
+func (f *File) setContent(content string) {
+	f.lines = lineStarts(content)
+	f.content = content
+}
+
+func lineStarts(content string) []int {
+	lines := []int{0}
+
+	for offset := 0; offset < len(content); offset++ {
+		if content[offset] == '\r' && offset+1 < len(content) && content[offset+1] == '\n' {
+			offset++
+		}
+
+		if (content[offset] == '\n' || content[offset] == '\r') && offset+1 < len(content) {
+			lines = append(lines, offset+1)
+		}
+	}
+
+	return lines
+}
+
+// countLineBreaks returns the number of line breaks in s, counting "\r\n"
+// as one.
+func countLineBreaks(s string) int {
+	return strings.Count(s, "\n") + strings.Count(s, "\r") - strings.Count(s, "\r\n")
+}
+
+// utf8BOM is the byte order mark some editors put at the start of UTF-8
+// files. It is not part of the source.
+const utf8BOM = "\xef\xbb\xbf"
+
+func stripBOM(content []byte) []byte {
+	return bytes.TrimPrefix(content, []byte(utf8BOM))
+}
+
+// Pos returns the Pos of offset, which is clamped to the file.
+func (f *File) Pos(offset int) Pos {
+	if offset < 0 {
+		offset = 0
+	} else if offset > f.size {
+		offset = f.size
+	}
+
+	return Pos(f.base + offset)
+}
+
+func (f *File) Offset(p Pos) int {
+	return int(p) - f.base
+}
+
+func (f *File) Position(p Pos) Position {
+	offset := f.Offset(p)
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset })
+
+	return Position{f.name, offset, line, offset - f.lines[line-1] + 1}
+}
+
+// FileSet assigns every file a range of Pos values so that a single Pos
+// identifies both a file and an offset in it. Files may be added while
+// positions are resolved, as a TokenStream preprocesses concurrently.
+type FileSet struct {
+	mutex sync.RWMutex
+	base  int
+	files []*File
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile registers a file of size bytes. A position just past the end of
+// the file is valid, so the next file starts one further on.
+func (s *FileSet) AddFile(filename string, size int) *File {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := &File{name: filename, base: s.base, size: size, lines: []int{0}}
+	s.base += size + 1
+	s.files = append(s.files, f)
+
+	return f
+}
+
+// File returns the file containing p, or nil.
+func (s *FileSet) File(p Pos) *File {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1
+
+	if i < 0 || int(p) > s.files[i].base+s.files[i].size {
+		return nil
+	}
+
+	return s.files[i]
+}
+
+// Text returns the source text from start up to end, or "" if they do not
+// lie in that order in one file whose content is kept.
+func (s *FileSet) Text(start Pos, end Pos) string {
+	f := s.File(start)
+
+	if f == nil || end < start || f.Offset(end) > len(f.content) {
+		return ""
+	}
+
+	return f.content[f.Offset(start):f.Offset(end)]
+}
+
+func (s *FileSet) Position(p Pos) Position {
+	if f := s.File(p); f != nil {
+		return f.Position(p)
+	}
+
+	return Position{}
+}
@@ -0,0 +1,1600 @@
+package frontend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxIncludeDepth = 200
+
+// SourceLine records where a line of preprocessed output came from. Line is
+// 1-based like Position.Line.
+type SourceLine struct {
+	File string
+	Line int
+
+	file     *File
+	offset   int
+	segments []lineSegment
+}
+
+// lineSegment maps the output text from byte Column of a preprocessed line
+// onwards back to the source file. Text copied from the source maps byte for
+// byte; every token of a macro expansion maps to the invocation Offset..End.
+type lineSegment struct {
+	Column   int
+	Offset   int
+	End      int
+	Expanded bool
+}
+
+// sourceSpan returns the source offsets of the output bytes from column
+// through column+length-1 of the line. The segments are in column order, so
+// the one containing column is found by binary search.
+func (sl SourceLine) sourceSpan(column int, length int) (int, int) {
+	seg := lineSegment{Offset: sl.offset}
+
+	if i := sort.Search(len(sl.segments), func(i int) bool { return sl.segments[i].Column > column }); i > 0 {
+		seg = sl.segments[i-1]
+	}
+
+	if seg.Expanded {
+		return seg.Offset, seg.End
+	}
+
+	offset := seg.Offset + column - seg.Column
+
+	return offset, offset + length
+}
+
+// logicalLine is a source line with its continuation lines spliced on.
+// starts holds the index in text where each physical line begins and
+// offsets its offset in the file.
+type logicalLine struct {
+	text    string
+	starts  []int
+	offsets []int
+}
+
+// offset maps an index in the text to the file offset it was read from.
+func (l *logicalLine) offset(i int) int {
+	k := len(l.starts) - 1
+
+	for k > 0 && l.starts[k] > i {
+		k--
+	}
+
+	return l.offsets[k] + i - l.starts[k]
+}
+
+type ppTokenType int
+
+const (
+	ppIdentifier ppTokenType = 0
+	ppNumber     ppTokenType = 1
+	ppString     ppTokenType = 2
+	ppComment    ppTokenType = 3
+	ppSpace      ppTokenType = 4
+	ppPunctuator ppTokenType = 5
+)
+
+// ppToken is a preprocessing token. Offset and End locate it in the source
+// file; Expanded marks tokens produced by a macro expansion, which are
+// located at the invocation. Hide lists the macros whose expansion produced
+// the token, which it is not expanded by again.
+type ppToken struct {
+	Type     ppTokenType
+	Text     string
+	Offset   int
+	End      int
+	Expanded bool
+	Hide     []string
+}
+
+type macro struct {
+	Name       string
+	Params     []string
+	IsFunction bool
+	Body       []ppToken
+}
+
+// param returns the index of the parameter name, or -1 if there is none.
+func (m *macro) param(name string) int {
+	for i, param := range m.Params {
+		if param == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+type conditional struct {
+	parentActive bool
+	active       bool
+	taken        bool
+	seenElse     bool
+	file         string
+	line         int
+}
+
+// covers tells whether the segment maps token, at column of the line, to
+// where it was read from.
+func (seg lineSegment) covers(token ppToken, column int) bool {
+	if token.Expanded != seg.Expanded {
+		return false
+	}
+
+	if token.Expanded {
+		return token.Offset == seg.Offset && token.End == seg.End
+	}
+
+	return token.Offset == seg.Offset+column-seg.Column
+}
+
+// Preprocessor expands #include, #define and conditional compilation
+// directives. Comments are passed through to the lexer untouched, and every
+// output line is mapped back to the file and line it was read from.
+type Preprocessor struct {
+	includePaths []string
+	macros       map[string]*macro
+	conds        []*conditional
+	fset         *FileSet
+	files        map[string]*File
+
+	// sources holds the file being read on top of those including it.
+	// output and lineMap hold the lines produced and not taken yet, and
+	// emitted counts all of them.
+	sources []*ppSource
+	output  strings.Builder
+	lineMap []SourceLine
+	emitted int
+
+	// Warnings holds the warnings about the -D options and the sources
+	// preprocessed so far. warningLines holds the number of lines output
+	// before each of them.
+	Warnings     DiagnosticList
+	warningLines []int
+}
+
+var ppPunctuators = []string{"...", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "##"}
+
+func NewPreprocessor(opts *Options) *Preprocessor {
+	pp := &Preprocessor{
+		macros: make(map[string]*macro),
+		fset:   NewFileSet(),
+		files:  make(map[string]*File)}
+
+	if opts != nil {
+		pp.includePaths = opts.IncludePaths
+
+		for name, value := range opts.Defines {
+			m, err := parseMacroDefinition(splitPPTokens(name+" "+value, false))
+
+			if err != nil {
+				pp.warnf(Position{Filename: "<command line>"}, "-D%s: %s", name, err)
+				continue
+			}
+
+			pp.macros[m.Name] = m
+		}
+	}
+
+	return pp
+}
+
+// Preprocess reads filename and returns the preprocessed source.
+func (pp *Preprocessor) Preprocess(filename string) (string, error) {
+	input, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return "", err
+	}
+
+	return pp.preprocess(filename, input)
+}
+
+// PreprocessReader preprocesses the source read from r. name is used in
+// diagnostics and positions, and quoted includes are searched for in its
+// directory.
+func (pp *Preprocessor) PreprocessReader(name string, r io.Reader) (string, error) {
+	input, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	return pp.preprocess(name, input)
+}
+
+func (pp *Preprocessor) preprocess(name string, input []byte) (string, error) {
+	pp.start(name, input)
+
+	for {
+		more, err := pp.next()
+
+		if err != nil {
+			return "", err
+		}
+
+		if !more {
+			return pp.output.String(), nil
+		}
+	}
+}
+
+// start begins preprocessing input, read from name, with no output yet.
+func (pp *Preprocessor) start(name string, input []byte) {
+	pp.sources = nil
+	pp.output.Reset()
+	pp.lineMap = []SourceLine{}
+	pp.emitted = 0
+	pp.open(name, input)
+}
+
+// readSize is about how much output read returns at a time.
+const readSize = 4096
+
+// read preprocesses the source started by start up to the end of the line,
+// outside a block comment, at which the output reaches readSize bytes, and
+// returns the output along with the origin of each line of it. The output
+// starts with a line break unless it starts the source, so that the last
+// line is not followed by one. There are no lines at the end of the source.
+func (pp *Preprocessor) read() (string, []SourceLine, error) {
+	for len(pp.lineMap) == 0 || pp.output.Len() < readSize || pp.inComment() {
+		more, err := pp.next()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	text, lines := pp.output.String(), pp.lineMap
+	pp.output.Reset()
+	pp.output.Grow(readSize + readSize/4)
+	pp.lineMap = make([]SourceLine, 0, len(lines))
+
+	return text, lines, nil
+}
+
+// LineMap returns the origin of every line produced by the last call to
+// Preprocess.
+func (pp *Preprocessor) LineMap() []SourceLine {
+	return pp.lineMap
+}
+
+// FileSet returns the set of files read by the preprocessor, which positions
+// derived from LineMap refer to.
+func (pp *Preprocessor) FileSet() *FileSet {
+	return pp.fset
+}
+
+// addFile registers a file the first time it is read.
+func (pp *Preprocessor) addFile(filename string, content string) *File {
+	if file, ok := pp.files[filename]; ok {
+		return file
+	}
+
+	file := pp.fset.AddFile(filename, len(content))
+	file.setContent(content)
+	pp.files[filename] = file
+
+	return file
+}
+
+// errorf returns an error on the 0-based line of file as a Diagnostic.
+func (pp *Preprocessor) errorf(file string, line int, format string, args ...interface{}) error {
+	return &Diagnostic{Position{Filename: file, Line: line + 1}, Severity_error, fmt.Sprintf(format, args...)}
+}
+
+func (pp *Preprocessor) warnf(pos Position, format string, args ...interface{}) {
+	pp.Warnings = append(pp.Warnings, &Diagnostic{pos, Severity_warning, fmt.Sprintf(format, args...)})
+	pp.warningLines = append(pp.warningLines, pp.emitted)
+}
+
+// emit outputs a line read from the 0-based line of file at offset.
+func (pp *Preprocessor) emit(text string, file *File, line int, offset int, segments []lineSegment) {
+	if pp.emitted > 0 {
+		pp.output.WriteByte('\n')
+	}
+
+	pp.output.WriteString(text)
+	pp.lineMap = append(pp.lineMap, SourceLine{file.Name(), line + 1, file, offset, segments})
+	pp.emitted++
+}
+
+// emitLine outputs line, leaving the lines read along with its first one
+// empty so that output lines stay in step with the source.
+func (pp *Preprocessor) emitLine(line *ppLine) {
+	src := line.source
+	pp.emit(line.text, src.file, line.start, src.r.offsets[line.start], line.segments)
+
+	for l := line.start + 1; l < line.end; l++ {
+		pp.emit("", src.file, l, src.r.offsets[l], nil)
+	}
+}
+
+func (pp *Preprocessor) isActive() bool {
+	return len(pp.conds) == 0 || pp.conds[len(pp.conds)-1].active
+}
+
+// ppSource is a source file being preprocessed. condDepth is the number of
+// conditionals open when it was opened, and held is the line that included
+// it, which is output after it.
+type ppSource struct {
+	name      string
+	file      *File
+	r         *lineReader
+	condDepth int
+	held      *ppLine
+}
+
+// ppLine is the output of the logical line of source from its start up to
+// end.
+type ppLine struct {
+	source   *ppSource
+	start    int
+	end      int
+	text     string
+	segments []lineSegment
+}
+
+// openFile reads filename and opens it on top of the source being read.
+func (pp *Preprocessor) openFile(filename string) error {
+	input, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	pp.open(filename, input)
+
+	return nil
+}
+
+func (pp *Preprocessor) open(filename string, input []byte) {
+	text := string(stripBOM(input))
+	lines, offsets := splitLines(text)
+
+	pp.sources = append(pp.sources, &ppSource{
+		name:      filename,
+		file:      pp.addFile(filename, text),
+		r:         &lineReader{lines: lines, offsets: offsets},
+		condDepth: len(pp.conds)})
+}
+
+// next preprocesses the next logical line of the source being read, or
+// closes it at its end, and reports whether there was anything left to do.
+func (pp *Preprocessor) next() (bool, error) {
+	if len(pp.sources) == 0 {
+		return false, nil
+	}
+
+	src := pp.sources[len(pp.sources)-1]
+
+	if src.r.next == len(src.r.lines) {
+		return true, pp.close()
+	}
+
+	start := src.r.next
+	text, segments, err := pp.processLine(src.name, start, src.r)
+
+	if err != nil {
+		return false, err
+	}
+
+	line := ppLine{src, start, src.r.next, text, segments}
+
+	// an #include has opened a file, which is output first
+	if top := pp.sources[len(pp.sources)-1]; top != src {
+		top.held = &line
+	} else {
+		pp.emitLine(&line)
+	}
+
+	return true, nil
+}
+
+// close ends the source being read, going back to the one including it.
+func (pp *Preprocessor) close() error {
+	src := pp.sources[len(pp.sources)-1]
+
+	if len(pp.conds) > src.condDepth {
+		cond := pp.conds[len(pp.conds)-1]
+		return pp.errorf(cond.file, cond.line, "unterminated conditional directive")
+	}
+
+	if src.r.inComment && len(pp.sources) > 1 {
+		return pp.errorf(src.name, len(src.r.lines)-1, "unterminated comment in included file")
+	}
+
+	pp.sources = pp.sources[:len(pp.sources)-1]
+
+	if src.held != nil {
+		pp.emitLine(src.held)
+	}
+
+	return nil
+}
+
+// inComment tells whether the source being read is inside a block comment.
+func (pp *Preprocessor) inComment() bool {
+	return len(pp.sources) > 0 && pp.sources[len(pp.sources)-1].r.inComment
+}
+
+// lineReader reads the logical lines of a source file as tokens, keeping
+// track of whether the next line starts inside a block comment. The tokens
+// of a line are read into buf, so they only last until the next read.
+type lineReader struct {
+	lines     []string
+	offsets   []int
+	next      int
+	inComment bool
+	buf       []ppToken
+}
+
+// read returns the tokens of the next logical line, located in the file.
+func (r *lineReader) read() []ppToken {
+	line := &logicalLine{r.lines[r.next], []int{0}, []int{r.offsets[r.next]}}
+
+	for strings.HasSuffix(line.text, "\\") && r.next+1 < len(r.lines) {
+		r.next++
+		line.text = line.text[:len(line.text)-1]
+		line.starts = append(line.starts, len(line.text))
+		line.offsets = append(line.offsets, r.offsets[r.next])
+		line.text += r.lines[r.next]
+	}
+
+	r.next++
+
+	tokens, inComment := splitPPTokensWithState(r.buf[:0], line.text, r.inComment)
+	r.buf, r.inComment = tokens, inComment
+
+	for i, index := 0, 0; i < len(tokens); i++ {
+		tokens[i].Offset = line.offset(index)
+		index += len(tokens[i].Text)
+		tokens[i].End = line.offset(index)
+	}
+
+	return tokens
+}
+
+// readText reads the next line for a macro invocation continuing onto it.
+// It reports false, reading nothing, at the end of the file and at a
+// directive.
+func (r *lineReader) readText() ([]ppToken, bool) {
+	if r.next == len(r.lines) {
+		return nil, false
+	}
+
+	next, inComment := r.next, r.inComment
+	tokens := r.read()
+
+	if directiveTokens(tokens) != nil {
+		r.next, r.inComment = next, inComment
+		return nil, false
+	}
+
+	return tokens, true
+}
+
+func (pp *Preprocessor) processLine(file string, line int, r *lineReader) (string, []lineSegment, error) {
+	startsInComment := r.inComment
+	tokens := r.read()
+
+	if directive := directiveTokens(tokens); directive != nil {
+		if err := pp.processDirective(file, line, directive); err != nil {
+			return "", nil, err
+		}
+
+		return commentPlaceholder(startsInComment, r.inComment), nil, nil
+	}
+
+	if !pp.isActive() {
+		return commentPlaceholder(startsInComment, r.inComment), nil, nil
+	}
+
+	expanded, err := pp.expand(tokens, r.readText)
+
+	if err != nil {
+		return "", nil, pp.errorf(file, line, "%s", err)
+	}
+
+	text, segments := joinExpanded(expanded, r.offsets[line])
+
+	return text, segments, nil
+}
+
+// joinExpanded returns the text of the tokens of a line starting at offset
+// and the segments mapping it back to the source. Tokens read in sequence
+// from the source share a segment, as do the tokens of one expansion, so a
+// line without macro invocations or continuations needs none.
+func joinExpanded(tokens []ppToken, offset int) (string, []lineSegment) {
+	var text strings.Builder
+	var segments []lineSegment
+
+	seg := lineSegment{Offset: offset}
+
+	for _, token := range tokens {
+		column := text.Len()
+
+		if !seg.covers(token, column) {
+			seg = lineSegment{column, token.Offset, token.End, token.Expanded}
+			segments = append(segments, seg)
+		}
+
+		text.WriteString(token.Text)
+	}
+
+	return text.String(), segments
+}
+
+// commentPlaceholder keeps the lexer's view of block comments in sync for
+// lines whose text is not passed through.
+func commentPlaceholder(startsInComment bool, endsInComment bool) string {
+	if startsInComment && !endsInComment {
+		return "*/"
+	} else if !startsInComment && endsInComment {
+		return "/*"
+	}
+
+	return ""
+}
+
+// directiveTokens returns the tokens following '#' with comments removed, or
+// nil if the line is not a directive.
+func directiveTokens(tokens []ppToken) []ppToken {
+	i := skipSpaces(tokens, 0)
+
+	if i >= len(tokens) || tokens[i].Type != ppPunctuator || tokens[i].Text != "#" {
+		return nil
+	}
+
+	directive := []ppToken{}
+
+	for _, token := range tokens[i+1:] {
+		if token.Type == ppComment {
+			token = ppToken{Type: ppSpace, Text: " "}
+		}
+
+		directive = append(directive, token)
+	}
+
+	return directive
+}
+
+func (pp *Preprocessor) processDirective(file string, line int, tokens []ppToken) error {
+	i := skipSpaces(tokens, 0)
+
+	if i >= len(tokens) {
+		return nil
+	}
+
+	name := tokens[i].Text
+	args := trimSpaces(tokens[i+1:])
+
+	switch name {
+	case "if", "ifdef", "ifndef":
+		cond := &conditional{parentActive: pp.isActive(), file: file, line: line}
+
+		if cond.parentActive {
+			value, err := pp.evalConditional(name, args)
+
+			if err != nil {
+				return pp.errorf(file, line, "#%s: %s", name, err)
+			}
+
+			cond.active = value
+			cond.taken = value
+		}
+
+		pp.conds = append(pp.conds, cond)
+	case "elif":
+		if len(pp.conds) == 0 {
+			return pp.errorf(file, line, "#elif without #if")
+		}
+
+		cond := pp.conds[len(pp.conds)-1]
+
+		if cond.seenElse {
+			return pp.errorf(file, line, "#elif after #else")
+		}
+
+		if cond.parentActive && !cond.taken {
+			value, err := pp.evalConditional(name, args)
+
+			if err != nil {
+				return pp.errorf(file, line, "#elif: %s", err)
+			}
+
+			cond.active = value
+			cond.taken = value
+		} else {
+			cond.active = false
+		}
+	case "else":
+		if len(pp.conds) == 0 {
+			return pp.errorf(file, line, "#else without #if")
+		}
+
+		cond := pp.conds[len(pp.conds)-1]
+
+		if cond.seenElse {
+			return pp.errorf(file, line, "#else after #else")
+		}
+
+		cond.seenElse = true
+		cond.active = cond.parentActive && !cond.taken
+		cond.taken = true
+	case "endif":
+		if len(pp.conds) == 0 {
+			return pp.errorf(file, line, "#endif without #if")
+		}
+
+		pp.conds = pp.conds[:len(pp.conds)-1]
+	default:
+		if !pp.isActive() {
+			return nil
+		}
+
+		return pp.processActiveDirective(file, line, name, args)
+	}
+
+	return nil
+}
+
+func (pp *Preprocessor) processActiveDirective(file string, line int, name string, args []ppToken) error {
+	switch name {
+	case "define":
+		m, err := parseMacroDefinition(args)
+
+		if err != nil {
+			return pp.errorf(file, line, "#define: %s", err)
+		}
+
+		if old, ok := pp.macros[m.Name]; ok && !sameMacro(old, m) {
+			pp.warnf(Position{Filename: file, Line: line + 1}, "%s redefined", m.Name)
+		}
+
+		pp.macros[m.Name] = m
+	case "undef":
+		if len(args) != 1 || args[0].Type != ppIdentifier {
+			return pp.errorf(file, line, "#undef: macro name expected")
+		}
+
+		delete(pp.macros, args[0].Text)
+	case "include":
+		return pp.processInclude(file, line, args)
+	case "error":
+		return pp.errorf(file, line, "#error %s", joinPPTokens(args))
+	case "pragma", "line":
+		// ignored
+	default:
+		return pp.errorf(file, line, "invalid preprocessing directive #%s", name)
+	}
+
+	return nil
+}
+
+func (pp *Preprocessor) processInclude(file string, line int, args []ppToken) error {
+	if len(args) > 0 && args[0].Type == ppIdentifier {
+		expanded, err := pp.expand(args, nil)
+
+		if err != nil {
+			return pp.errorf(file, line, "#include: %s", err)
+		}
+
+		args = trimSpaces(expanded)
+	}
+
+	spec := joinPPTokens(args)
+	var name string
+	var searchPaths []string
+
+	if len(spec) > 2 && spec[0] == '"' && spec[len(spec)-1] == '"' {
+		name = spec[1 : len(spec)-1]
+		searchPaths = append([]string{filepath.Dir(file)}, pp.includePaths...)
+	} else if len(spec) > 2 && spec[0] == '<' && spec[len(spec)-1] == '>' {
+		name = spec[1 : len(spec)-1]
+		searchPaths = pp.includePaths
+	} else {
+		return pp.errorf(file, line, "#include expects \"FILENAME\" or <FILENAME>")
+	}
+
+	if len(pp.sources) > maxIncludeDepth {
+		return pp.errorf(file, line, "#include nested too deeply")
+	}
+
+	for _, dir := range searchPaths {
+		path := name
+
+		if !filepath.IsAbs(name) {
+			path = filepath.Join(dir, name)
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			if err := pp.openFile(path); err != nil {
+				return pp.errorf(file, line, "#include: %s", err)
+			}
+
+			return nil
+		}
+	}
+
+	return pp.errorf(file, line, "%s: no such file", name)
+}
+
+func parseMacroDefinition(tokens []ppToken) (*macro, error) {
+	i := skipSpaces(tokens, 0)
+
+	if i >= len(tokens) || tokens[i].Type != ppIdentifier {
+		return nil, fmt.Errorf("macro name expected")
+	}
+
+	m := &macro{Name: tokens[i].Text}
+	i++
+
+	// a function-like macro has its '(' directly after the name
+	if i < len(tokens) && tokens[i].Text == "(" {
+		m.IsFunction = true
+		m.Params = []string{}
+		i = skipSpaces(tokens, i+1)
+
+		if i < len(tokens) && tokens[i].Text == ")" {
+			i++
+		} else {
+			for {
+				if i >= len(tokens) || tokens[i].Type != ppIdentifier {
+					return nil, fmt.Errorf("parameter name expected in macro %s", m.Name)
+				}
+
+				if m.param(tokens[i].Text) >= 0 {
+					return nil, fmt.Errorf("duplicate parameter %s in macro %s", tokens[i].Text, m.Name)
+				}
+
+				m.Params = append(m.Params, tokens[i].Text)
+				i = skipSpaces(tokens, i+1)
+
+				if i < len(tokens) && tokens[i].Text == ")" {
+					i++
+					break
+				} else if i < len(tokens) && tokens[i].Text == "," {
+					i = skipSpaces(tokens, i+1)
+				} else {
+					return nil, fmt.Errorf("expected ',' or ')' in parameters of macro %s", m.Name)
+				}
+			}
+		}
+	}
+
+	m.Body = trimSpaces(tokens[i:])
+
+	for i, token := range m.Body {
+		if token.Type != ppPunctuator {
+			continue
+		}
+
+		if token.Text == "##" && (i == 0 || i == len(m.Body)-1) {
+			return nil, fmt.Errorf("'##' cannot appear at either end of macro %s", m.Name)
+		}
+
+		// '#' is only an operator in a function-like macro
+		if j := skipSpaces(m.Body, i+1); token.Text == "#" && m.IsFunction &&
+			(j == len(m.Body) || m.Body[j].Type != ppIdentifier || m.param(m.Body[j].Text) < 0) {
+			return nil, fmt.Errorf("'#' is not followed by a parameter of macro %s", m.Name)
+		}
+	}
+
+	return m, nil
+}
+
+func sameMacro(a *macro, b *macro) bool {
+	return a.IsFunction == b.IsFunction &&
+		strings.Join(a.Params, ",") == strings.Join(b.Params, ",") &&
+		joinPPTokens(a.Body) == joinPPTokens(b.Body)
+}
+
+// expand replaces macro invocations in tokens. Each replacement is rescanned
+// together with the tokens following it, so it may use them as the
+// arguments of a further invocation. A token is not expanded by the macros
+// in its hide set, which keeps a macro from expanding within itself. more
+// returns the tokens of the next line when an invocation continues past
+// the end of tokens, or false if there is none; it is nil when tokens
+// cannot continue.
+func (pp *Preprocessor) expand(tokens []ppToken, more func() ([]ppToken, bool)) ([]ppToken, error) {
+	// most lines invoke no macro and pass through as they are
+	if !pp.invokesMacro(tokens) {
+		return tokens, nil
+	}
+
+	result := []ppToken{}
+
+	// tokens is always the tail of buf, which is ours to overwrite
+	buf := append([]ppToken{}, tokens...)
+	tokens = buf
+
+	for len(tokens) > 0 {
+		token := tokens[0]
+		m, isMacro := pp.macros[token.Text]
+
+		if token.Type != ppIdentifier || !isMacro || inHideSet(token.Hide, m.Name) {
+			result = appendPPTokens(result, token)
+			tokens = tokens[1:]
+			continue
+		}
+
+		body := m.Body
+		invocation := token
+		hide := token.Hide
+		rest := tokens[1:]
+
+		if m.IsFunction {
+			open := skipSpaces(tokens, 1)
+
+			for open == len(tokens) && more != nil {
+				next, ok := more()
+
+				if !ok {
+					break
+				}
+
+				tokens = joinLines(tokens, next)
+				buf = tokens
+				open = skipSpaces(tokens, open)
+			}
+
+			if open == len(tokens) || tokens[open].Text != "(" {
+				result = appendPPTokens(result, token)
+				tokens = tokens[1:]
+				continue
+			}
+
+			args, end, err := collectMacroArgs(tokens, open)
+
+			for err != nil && more != nil {
+				next, ok := more()
+
+				if !ok {
+					break
+				}
+
+				tokens = joinLines(tokens, next)
+				buf = tokens
+				args, end, err = collectMacroArgs(tokens, open)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s invoking macro %s", err, m.Name)
+			}
+
+			if len(m.Params) == 0 && len(args) == 1 && len(args[0]) == 0 {
+				args = [][]ppToken{}
+			}
+
+			if len(args) != len(m.Params) {
+				return nil, fmt.Errorf("macro %s expects %d arguments, but %d given",
+					m.Name, len(m.Params), len(args))
+			}
+
+			expanded := make([][]ppToken, len(args))
+
+			for j, arg := range args {
+				if expanded[j], err = pp.expand(arg, nil); err != nil {
+					return nil, err
+				}
+			}
+
+			if body, err = substituteMacroArgs(m, args, expanded); err != nil {
+				return nil, err
+			}
+
+			invocation.End = tokens[end].End
+			hide = intersectHideSets(token.Hide, tokens[end].Hide)
+			rest = tokens[end+1:]
+		} else if hasPPToken(body, "##") {
+			var err error
+
+			if body, err = substituteMacroArgs(m, nil, nil); err != nil {
+				return nil, err
+			}
+		}
+
+		hide = unionHideSets(hide, []string{m.Name})
+		replacement := make([]ppToken, len(body))
+
+		for j, t := range body {
+			t.Offset = invocation.Offset
+			t.End = invocation.End
+			t.Expanded = true
+			t.Hide = unionHideSets(t.Hide, hide)
+			replacement[j] = t
+		}
+
+		buf, tokens = prependPPTokens(buf, rest, replacement)
+	}
+
+	return result, nil
+}
+
+// invokesMacro tells whether any of tokens names a macro that may expand.
+func (pp *Preprocessor) invokesMacro(tokens []ppToken) bool {
+	for _, token := range tokens {
+		if token.Type == ppIdentifier {
+			if m, isMacro := pp.macros[token.Text]; isMacro && !inHideSet(token.Hide, m.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// prependPPTokens returns front followed by rest, which is the tail of buf,
+// and the slice it is the tail of. front goes in the space before rest that
+// the tokens read from buf have left if it fits, or else in a new slice with
+// as much space again, so that rescanning a long line does not copy what
+// follows every invocation in it.
+func prependPPTokens(buf []ppToken, rest []ppToken, front []ppToken) ([]ppToken, []ppToken) {
+	free := len(buf) - len(rest)
+
+	if free < len(front) {
+		size := len(front) + len(rest)
+		buf = make([]ppToken, 2*size)
+		free = size + len(front)
+		copy(buf[free:], rest)
+	}
+
+	copy(buf[free-len(front):], front)
+
+	return buf, buf[free-len(front):]
+}
+
+// joinLines appends the tokens of the next line to tokens, with a space for
+// the line break. A line comment ending tokens becomes a space too, as it
+// would otherwise run on over the next line.
+func joinLines(tokens []ppToken, next []ppToken) []ppToken {
+	joined := make([]ppToken, len(tokens), len(tokens)+1+len(next))
+	copy(joined, tokens)
+	last := &joined[len(joined)-1]
+
+	if last.Type == ppComment && strings.HasPrefix(last.Text, "//") {
+		*last = ppToken{Type: ppSpace, Text: " ", Offset: last.Offset, End: last.End}
+	}
+
+	joined = append(joined, ppToken{Type: ppSpace, Text: " ", Offset: last.End, End: last.End})
+
+	return append(joined, next...)
+}
+
+func inHideSet(hide []string, name string) bool {
+	for _, hidden := range hide {
+		if hidden == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unionHideSets(a []string, b []string) []string {
+	union := append([]string{}, a...)
+
+	for _, name := range b {
+		if !inHideSet(union, name) {
+			union = append(union, name)
+		}
+	}
+
+	return union
+}
+
+func intersectHideSets(a []string, b []string) []string {
+	intersection := []string{}
+
+	for _, name := range a {
+		if inHideSet(b, name) {
+			intersection = append(intersection, name)
+		}
+	}
+
+	return intersection
+}
+
+// collectMacroArgs splits the parenthesized argument list starting at open
+// and returns the arguments and the index of the closing ')'. Comments in
+// the arguments are spaces.
+func collectMacroArgs(tokens []ppToken, open int) (args [][]ppToken, end int, err error) {
+	depth := 0
+	arg := []ppToken{}
+
+	for end = open + 1; end < len(tokens); end++ {
+		token := tokens[end]
+
+		if token.Type == ppComment {
+			token = ppToken{Type: ppSpace, Text: " ", Offset: token.Offset, End: token.End}
+		}
+
+		if token.Type == ppPunctuator {
+			switch token.Text {
+			case "(":
+				depth++
+			case ")":
+				if depth == 0 {
+					args = append(args, trimSpaces(arg))
+					return
+				}
+
+				depth--
+			case ",":
+				if depth == 0 {
+					args = append(args, trimSpaces(arg))
+					arg = []ppToken{}
+					continue
+				}
+			}
+		}
+
+		arg = append(arg, token)
+	}
+
+	return nil, end, fmt.Errorf("unterminated argument list")
+}
+
+// substituteMacroArgs returns the body of m with its parameters replaced
+// by args as given where they are operands of '#' or '##', and as expanded
+// elsewhere. '#' makes a string literal of its operand and '##' pastes its
+// operands into one token, dropping the spaces around it; an empty operand
+// leaves the other as it is.
+func substituteMacroArgs(m *macro, args [][]ppToken, expanded [][]ppToken) ([]ppToken, error) {
+	result := []ppToken{}
+	body := m.Body
+
+	// pasting is set by '##' until its right operand, and operand is where
+	// the last operand starts in result
+	pasting := false
+	operand := 0
+
+	for i := 0; i < len(body); i++ {
+		token := body[i]
+		next := skipSpaces(body, i+1)
+		pasted := next < len(body) && body[next].Text == "##"
+		tokens := []ppToken{token}
+
+		switch param := m.param(token.Text); {
+		case token.Type == ppSpace || token.Type == ppComment:
+			if pasting || pasted {
+				continue
+			}
+		case token.Type == ppPunctuator && token.Text == "##":
+			pasting = true
+			continue
+		case token.Type == ppPunctuator && token.Text == "#" && m.IsFunction:
+			tokens = []ppToken{stringifyPPTokens(args[m.param(body[next].Text)])}
+			i = next
+		case token.Type == ppIdentifier && param >= 0 && (pasting || pasted):
+			tokens = args[param]
+		case token.Type == ppIdentifier && param >= 0:
+			tokens = expanded[param]
+		}
+
+		if pasting && len(tokens) > 0 && len(result) > operand {
+			last := result[len(result)-1]
+			text := last.Text + tokens[0].Text
+			paste := splitPPTokens(text, false)
+
+			if len(paste) != 1 {
+				return nil, fmt.Errorf("pasting \"%s\" and \"%s\" does not give a valid preprocessing token in macro %s",
+					last.Text, tokens[0].Text, m.Name)
+			}
+
+			result[len(result)-1] = ppToken{Type: paste[0].Type, Text: text}
+			tokens = tokens[1:]
+		}
+
+		if !pasting && token.Type != ppSpace && token.Type != ppComment {
+			operand = len(result)
+		}
+
+		pasting = false
+		result = appendPPTokens(result, tokens...)
+	}
+
+	return result, nil
+}
+
+// stringifyPPTokens returns the string literal '#' makes of an argument. It
+// has the text of the argument with a space for each run of spaces and
+// comments, and a '\' before each '"' and '\' of its literals.
+func stringifyPPTokens(tokens []ppToken) ppToken {
+	var text strings.Builder
+
+	text.WriteByte('"')
+
+	for i, token := range tokens {
+		switch token.Type {
+		case ppSpace, ppComment:
+			if i > 0 && tokens[i-1].Type != ppSpace && tokens[i-1].Type != ppComment {
+				text.WriteByte(' ')
+			}
+		case ppString:
+			for j := 0; j < len(token.Text); j++ {
+				if token.Text[j] == '"' || token.Text[j] == '\\' {
+					text.WriteByte('\\')
+				}
+
+				text.WriteByte(token.Text[j])
+			}
+		default:
+			text.WriteString(token.Text)
+		}
+	}
+
+	text.WriteByte('"')
+
+	return ppToken{Type: ppString, Text: text.String()}
+}
+
+// hasPPToken tells whether tokens include the punctuator text.
+func hasPPToken(tokens []ppToken, text string) bool {
+	for _, token := range tokens {
+		if token.Type == ppPunctuator && token.Text == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendPPTokens appends tokens to result, separating them with a space
+// where joining the text would paste two tokens into one.
+func appendPPTokens(result []ppToken, tokens ...ppToken) []ppToken {
+	if len(result) > 0 && len(tokens) > 0 &&
+		isWordToken(result[len(result)-1]) && isWordToken(tokens[0]) {
+		result = append(result, ppToken{Type: ppSpace, Text: " "})
+	}
+
+	return append(result, tokens...)
+}
+
+func isWordToken(token ppToken) bool {
+	return token.Type == ppIdentifier || token.Type == ppNumber
+}
+
+func (pp *Preprocessor) evalConditional(directive string, args []ppToken) (bool, error) {
+	if directive == "ifdef" || directive == "ifndef" {
+		if len(args) != 1 || args[0].Type != ppIdentifier {
+			return false, fmt.Errorf("macro name expected")
+		}
+
+		_, defined := pp.macros[args[0].Text]
+
+		return defined == (directive == "ifdef"), nil
+	}
+
+	tokens := []ppToken{}
+
+	for i := 0; i < len(args); i++ {
+		if args[i].Type != ppIdentifier || args[i].Text != "defined" {
+			tokens = append(tokens, args[i])
+			continue
+		}
+
+		j := skipSpaces(args, i+1)
+		parenthesized := j < len(args) && args[j].Text == "("
+
+		if parenthesized {
+			j = skipSpaces(args, j+1)
+		}
+
+		if j >= len(args) || args[j].Type != ppIdentifier {
+			return false, fmt.Errorf("operator \"defined\" requires an identifier")
+		}
+
+		_, defined := pp.macros[args[j].Text]
+
+		if parenthesized {
+			j = skipSpaces(args, j+1)
+
+			if j >= len(args) || args[j].Text != ")" {
+				return false, fmt.Errorf("missing ')' after \"defined\"")
+			}
+		}
+
+		if defined {
+			tokens = append(tokens, ppToken{Type: ppNumber, Text: "1"})
+		} else {
+			tokens = append(tokens, ppToken{Type: ppNumber, Text: "0"})
+		}
+
+		i = j
+	}
+
+	expanded, err := pp.expand(tokens, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	e := &ppExpr{}
+
+	for _, token := range expanded {
+		if token.Type != ppSpace && token.Type != ppComment {
+			e.tokens = append(e.tokens, token)
+		}
+	}
+
+	if len(e.tokens) == 0 {
+		return false, fmt.Errorf("no expression")
+	}
+
+	value := e.parse(0, true)
+
+	if e.err == nil && e.pos < len(e.tokens) {
+		e.err = fmt.Errorf("unexpected '%s' in expression", e.tokens[e.pos].Text)
+	}
+
+	return value != 0, e.err
+}
+
+// ppExpr evaluates the integer constant expressions of #if and #elif.
+type ppExpr struct {
+	tokens []ppToken
+	pos    int
+	err    error
+}
+
+var ppBinaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+func (e *ppExpr) peek() string {
+	if e.pos < len(e.tokens) && e.tokens[e.pos].Type == ppPunctuator {
+		return e.tokens[e.pos].Text
+	}
+
+	return ""
+}
+
+func (e *ppExpr) fail(format string, args ...interface{}) int64 {
+	if e.err == nil {
+		e.err = fmt.Errorf(format, args...)
+	}
+
+	return 0
+}
+
+// parse evaluates a (conditional) expression whose binary operators bind at
+// least as tightly as minPrec. Division by zero is only an error when eval
+// is set, so that "0 && 1 / 0" is accepted as in C.
+func (e *ppExpr) parse(minPrec int, eval bool) int64 {
+	lhs := e.parseUnary(eval)
+
+	for e.err == nil {
+		op := e.peek()
+		prec, isBinary := ppBinaryPrecedence[op]
+
+		if op == "?" && minPrec == 0 {
+			e.pos++
+			then := e.parse(0, eval && lhs != 0)
+
+			if e.peek() != ":" {
+				return e.fail("expected ':' in conditional expression")
+			}
+
+			e.pos++
+			otherwise := e.parse(0, eval && lhs == 0)
+
+			if lhs != 0 {
+				lhs = then
+			} else {
+				lhs = otherwise
+			}
+
+			continue
+		}
+
+		if !isBinary || prec < minPrec {
+			break
+		}
+
+		e.pos++
+
+		switch op {
+		case "&&":
+			rhs := e.parse(prec+1, eval && lhs != 0)
+			lhs = boolToInt(lhs != 0 && rhs != 0)
+		case "||":
+			rhs := e.parse(prec+1, eval && lhs == 0)
+			lhs = boolToInt(lhs != 0 || rhs != 0)
+		default:
+			lhs = e.apply(op, lhs, e.parse(prec+1, eval), eval)
+		}
+	}
+
+	return lhs
+}
+
+func (e *ppExpr) apply(op string, lhs int64, rhs int64, eval bool) int64 {
+	switch op {
+	case "|":
+		return lhs | rhs
+	case "^":
+		return lhs ^ rhs
+	case "&":
+		return lhs & rhs
+	case "==":
+		return boolToInt(lhs == rhs)
+	case "!=":
+		return boolToInt(lhs != rhs)
+	case "<":
+		return boolToInt(lhs < rhs)
+	case "<=":
+		return boolToInt(lhs <= rhs)
+	case ">":
+		return boolToInt(lhs > rhs)
+	case ">=":
+		return boolToInt(lhs >= rhs)
+	case "<<":
+		return lhs << uint64(rhs)
+	case ">>":
+		return lhs >> uint64(rhs)
+	case "+":
+		return lhs + rhs
+	case "-":
+		return lhs - rhs
+	case "*":
+		return lhs * rhs
+	}
+
+	if rhs == 0 {
+		if eval {
+			return e.fail("division by zero")
+		}
+
+		return 0
+	}
+
+	if op == "/" {
+		return lhs / rhs
+	}
+
+	return lhs % rhs
+}
+
+func (e *ppExpr) parseUnary(eval bool) int64 {
+	if e.pos >= len(e.tokens) {
+		return e.fail("unexpected end of expression")
+	}
+
+	token := e.tokens[e.pos]
+	e.pos++
+
+	switch {
+	case token.Type == ppPunctuator && token.Text == "(":
+		value := e.parse(0, eval)
+
+		if e.peek() != ")" {
+			return e.fail("missing ')' in expression")
+		}
+
+		e.pos++
+
+		return value
+	case token.Type == ppPunctuator && token.Text == "!":
+		return boolToInt(e.parseUnary(eval) == 0)
+	case token.Type == ppPunctuator && token.Text == "~":
+		return ^e.parseUnary(eval)
+	case token.Type == ppPunctuator && token.Text == "-":
+		return -e.parseUnary(eval)
+	case token.Type == ppPunctuator && token.Text == "+":
+		return e.parseUnary(eval)
+	case token.Type == ppNumber:
+		value, err := strconv.ParseInt(strings.TrimRight(token.Text, "uUlL"), 0, 64)
+
+		if err != nil {
+			return e.fail("invalid integer constant %s", token.Text)
+		}
+
+		return value
+	case token.Type == ppString && token.Text[0] == '\'':
+		value, _, _, err := strconv.UnquoteChar(token.Text[1:], '\'')
+
+		if err != nil {
+			return e.fail("invalid character constant %s", token.Text)
+		}
+
+		return int64(value)
+	case token.Type == ppIdentifier:
+		// identifiers left after macro expansion evaluate to 0
+		return 0
+	}
+
+	return e.fail("unexpected '%s' in expression", token.Text)
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func splitPPTokens(text string, inComment bool) []ppToken {
+	tokens, _ := splitPPTokensWithState(nil, text, inComment)
+
+	return tokens
+}
+
+// splitPPTokensWithState splits a logical source line into preprocessing
+// tokens, which it appends to tokens. inComment tells whether the line starts
+// inside a block comment; the returned flag tells whether it ends inside one.
+func splitPPTokensWithState(tokens []ppToken, text string, inComment bool) ([]ppToken, bool) {
+	i := 0
+
+	if inComment {
+		end := strings.Index(text, "*/")
+
+		if end < 0 {
+			return append(tokens, ppToken{Type: ppComment, Text: text}), true
+		}
+
+		tokens = append(tokens, ppToken{Type: ppComment, Text: text[:end+2]})
+		i = end + 2
+	}
+
+	for i < len(text) {
+		start := i
+		c := text[i]
+		tokenType := ppPunctuator
+
+		switch {
+		case strings.HasPrefix(text[i:], "//"):
+			i = len(text)
+			tokenType = ppComment
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+
+			if end < 0 {
+				return append(tokens, ppToken{Type: ppComment, Text: text[i:]}), true
+			}
+
+			i += end + 4
+			tokenType = ppComment
+		case isIdentifierStart(c):
+			for i < len(text) && (isIdentifierStart(text[i]) || isDigit(text[i])) {
+				i++
+			}
+
+			tokenType = ppIdentifier
+		case isDigit(c):
+			for i < len(text) && (isIdentifierStart(text[i]) || isDigit(text[i]) || text[i] == '.') {
+				i++
+			}
+
+			tokenType = ppNumber
+		case c == '"' || c == '\'':
+			for i++; i < len(text) && text[i] != c; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+
+			if i < len(text) {
+				i++
+			} else {
+				i = len(text)
+			}
+
+			tokenType = ppString
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			for i < len(text) && strings.IndexByte(" \t\r\v\f", text[i]) >= 0 {
+				i++
+			}
+
+			tokenType = ppSpace
+		default:
+			i++
+
+			for _, punctuator := range ppPunctuators {
+				if strings.HasPrefix(text[start:], punctuator) {
+					i = start + len(punctuator)
+					break
+				}
+			}
+		}
+
+		tokens = append(tokens, ppToken{Type: tokenType, Text: text[start:i]})
+	}
+
+	return tokens, false
+}
+
+// splitLines splits text at "\n", "\r\n" and lone "\r" line breaks. It
+// returns the lines without their line breaks and the offset each starts at.
+// A final line break does not start another line.
+func splitLines(text string) ([]string, []int) {
+	lines, offsets := []string{}, []int{0}
+
+	for start, i := 0, 0; ; i++ {
+		if i == len(text) {
+			if start < len(text) || len(lines) == 0 {
+				lines = append(lines, text[start:])
+			} else {
+				offsets = offsets[:len(lines)]
+			}
+
+			return lines, offsets
+		}
+
+		if text[i] == '\n' || text[i] == '\r' {
+			lines = append(lines, text[start:i])
+
+			if text[i] == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+
+			start = i + 1
+			offsets = append(offsets, start)
+		}
+	}
+}
+
+// isIdentifierStart also accepts the bytes of UTF-8 sequences so that words
+// stay whole; whether they may be part of identifiers is up to the lexer.
+func isIdentifierStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= utf8.RuneSelf
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func skipSpaces(tokens []ppToken, i int) int {
+	for i < len(tokens) && (tokens[i].Type == ppSpace || tokens[i].Type == ppComment) {
+		i++
+	}
+
+	return i
+}
+
+func trimSpaces(tokens []ppToken) []ppToken {
+	start := skipSpaces(tokens, 0)
+	end := len(tokens)
+
+	for end > start && (tokens[end-1].Type == ppSpace || tokens[end-1].Type == ppComment) {
+		end--
+	}
+
+	return tokens[start:end]
+}
+
+func joinPPTokens(tokens []ppToken) string {
+	texts := make([]string, len(tokens))
+
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+
+	return strings.Join(texts, "")
+}
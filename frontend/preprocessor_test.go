@@ -0,0 +1,189 @@
+package frontend
+
+import (
+	"github.com/coocood/assrt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "preprocessor_test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestPreprocessMacros(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	dir := writeTestFiles(t, map[string]string{
+		"main.xxx": "#define TEN 10\n" +
+			"#define ADD(a, b) ((a) + (b))\n" +
+			"#define TWICE(x) ADD(x, x)\n" +
+			"i = TWICE(TEN) /* TEN */;\n" +
+			"#undef TEN\n" +
+			"j = TEN;\n"})
+	defer os.RemoveAll(dir)
+
+	output, err := NewPreprocessor(&Options{}).Preprocess(filepath.Join(dir, "main.xxx"))
+
+	assert.Nil(err)
+	assert.Equal("\n\n\ni = ((10) + (10)) /* TEN */;\n\nj = TEN;", output)
+}
+
+func TestPreprocessMacrosAcrossLines(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	dir := writeTestFiles(t, map[string]string{
+		"main.xxx": "#define ADD(a, b) ((a) + (b))\n" +
+			"#define f g\n" +
+			"#define g(x) x\n" +
+			"i = ADD(1, // one\n" +
+			"  2) + ADD\n" +
+			"(3, 4);\n" +
+			"j = f(5) + g\n" +
+			"+ f;\n",
+		"unterminated.xxx": "#define ADD(a, b) ((a) + (b))\n" +
+			"i = ADD(1,\n" +
+			"#undef ADD\n" +
+			"2);\n"})
+	defer os.RemoveAll(dir)
+
+	// an invocation is read up to its ')', and a replacement takes the
+	// following tokens as its arguments
+	output, err := NewPreprocessor(&Options{}).Preprocess(filepath.Join(dir, "main.xxx"))
+	assert.Nil(err)
+	assert.Equal("\n\n\ni = ((1) + (2)) + ((3) + (4));\n\n\nj = 5 + g + g;\n", output)
+
+	_, err = NewPreprocessor(&Options{}).Preprocess(filepath.Join(dir, "unterminated.xxx"))
+	assert.MustNotNil(err)
+	assert.Equal(filepath.Join(dir, "unterminated.xxx")+":2: error: unterminated argument list invoking macro ADD", err.Error())
+
+	// the tokens after an invocation keep the line they were read from
+	tokens, err := LexString("t.xxx", "int x = ADD(1,\n  2) + y;\n", &Options{Defines: map[string]string{"ADD(a, b)": "a + b"}})
+	assert.MustNil(err)
+	assert.Equal("y", tokens.Tokens[len(tokens.Tokens)-3].TokenString)
+	assert.Equal(2, tokens.Position(tokens.Tokens[len(tokens.Tokens)-3]).Line)
+	assert.Equal(8, tokens.Position(tokens.Tokens[len(tokens.Tokens)-3]).Column)
+}
+
+func TestPreprocessMacroOperators(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	defines := "#define STR(x) #x\n#define XSTR(x) STR(x)\n#define CAT(a, b) a ## b\n#define TEN 10\n"
+
+	// the operands of '#' and '##' are not expanded, but what '##' pastes is
+	// rescanned; '#' is an ordinary token in an object-like macro
+	output, err := NewPreprocessor(&Options{}).PreprocessReader("t.xxx", strings.NewReader(defines+
+		"#define OBJ x ## 1\n#define HASH # x\n"+
+		"s = STR(TEN  +  \"a\\n\" /* c */ 'b');\n"+
+		"t = XSTR(TEN);\n"+
+		"u = CAT(T, EN) + CAT(, TEN) + CAT(TEN,) + CAT(1, 2.5) + CAT(,);\n"+
+		"v = OBJ + HASH + CAT(<, <) CAT(x, /* c */ y) CAT(a b, c d);\n"))
+	assert.MustNil(err)
+	assert.Equal("\n\n\n\n\n\n"+
+		"s = \"TEN + \\\"a\\\\n\\\" 'b'\";\n"+
+		"t = \"10\";\n"+
+		"u = 10 + 10 + 10 + 12.5 + ;\n"+
+		"v = x1 + # x + << xy a bc d;", output)
+
+	for src, message := range map[string]string{
+		"#define F(x) #y\n":              "t.xxx:1: error: #define: '#' is not followed by a parameter of macro F",
+		"#define G ## x\n":               "t.xxx:1: error: #define: '##' cannot appear at either end of macro G",
+		"#define G(x) x ##\n":            "t.xxx:1: error: #define: '##' cannot appear at either end of macro G",
+		defines + "int x = CAT(+, -);\n": "t.xxx:5: error: pasting \"+\" and \"-\" does not give a valid preprocessing token in macro CAT",
+	} {
+		_, err := NewPreprocessor(&Options{}).PreprocessReader("t.xxx", strings.NewReader(src))
+		assert.MustNotNil(err, src)
+		assert.Equal(message, err.Error())
+	}
+
+	// a stringified argument lexes as one string literal
+	tokens, err := LexString("t.xxx", defines+"char *s = STR(say \"hi\");\n", &Options{})
+	assert.MustNil(err)
+	assert.Equal(TOK_STRING, tokens.Tokens[4].Type)
+	assert.Equal(`"say \"hi\""`, tokens.Tokens[4].TokenString)
+}
+
+func TestPreprocessWarnings(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	pp := NewPreprocessor(&Options{Defines: map[string]string{"1X": "1"}})
+	_, err := pp.PreprocessReader("t.xxx", strings.NewReader("#define A 1\n#define A 1\n#define A 2\n"))
+	assert.MustNil(err)
+	assert.MustEqual(2, len(pp.Warnings))
+	assert.Equal("<command line>: warning: -D1X: macro name expected", pp.Warnings[0].Error())
+	assert.Equal("t.xxx:3: warning: A redefined", pp.Warnings[1].Error())
+}
+
+func TestPreprocessConditionals(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	dir := writeTestFiles(t, map[string]string{
+		"main.xxx": "#if defined(A) && B * 2 > 3\n" +
+			"a\n" +
+			"#elif !defined A\n" +
+			"b\n" +
+			"#else\n" +
+			"c\n" +
+			"#endif\n" +
+			"#ifndef B\n" +
+			"d\n" +
+			"#endif\n"})
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "main.xxx")
+
+	output, err := NewPreprocessor(&Options{Defines: map[string]string{"A": "1", "B": "2"}}).Preprocess(filename)
+	assert.Nil(err)
+	assert.Equal("\na\n\n\n\n\n\n\n\n", output)
+
+	output, err = NewPreprocessor(&Options{}).Preprocess(filename)
+	assert.Nil(err)
+	assert.Equal("\n\n\nb\n\n\n\n\nd\n", output)
+
+	output, err = NewPreprocessor(&Options{Defines: map[string]string{"A": "1"}}).Preprocess(filename)
+	assert.Nil(err)
+	assert.Equal("\n\n\n\n\nc\n\n\nd\n", output)
+}
+
+func TestPreprocessInclude(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	dir := writeTestFiles(t, map[string]string{
+		"main.xxx":     "#include \"local.h\"\n#include <lib.h>\nint x;\n",
+		"local.h":      "int l;\n",
+		"inc/lib.h":    "#ifndef LIB_H\n#define LIB_H\nint lib;\n#include <lib.h>\n#endif\n",
+		"unterminated": "#if 1\n"})
+	defer os.RemoveAll(dir)
+
+	pp := NewPreprocessor(&Options{IncludePaths: []string{filepath.Join(dir, "inc")}})
+	output, err := pp.Preprocess(filepath.Join(dir, "main.xxx"))
+
+	assert.Nil(err)
+	assert.Equal("int l;\n\n\n\nint lib;\n\n\n\n\n\n\n\n\nint x;", output)
+
+	lineMap := pp.LineMap()
+	assert.Equal(filepath.Join(dir, "local.h"), lineMap[0].File)
+	assert.Equal(1, lineMap[0].Line)
+	assert.Equal(filepath.Join(dir, "inc", "lib.h"), lineMap[4].File)
+	assert.Equal(3, lineMap[4].Line)
+	assert.Equal(filepath.Join(dir, "main.xxx"), lineMap[13].File)
+	assert.Equal(3, lineMap[13].Line)
+
+	_, err = NewPreprocessor(&Options{}).Preprocess(filepath.Join(dir, "main.xxx"))
+	assert.NotNil(err)
+
+	_, err = NewPreprocessor(&Options{}).Preprocess(filepath.Join(dir, "unterminated"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,90 @@
+package frontend
+
+// recover is called when the declaration or statement starting at start
+// fails to parse, with the number of errors reported before it. Unless more
+// have been reported since, it reports what the parser expected at the
+// furthest point it reached. It then skips tokens from there in panic mode,
+// up to and including the next ';' or the '}' closing a block it skipped
+// into. It stops short at the '}' closing the function body, and at the
+// start of a line, which begins the next statement when a ';' is missing;
+// at the top level, only if the line begins a declaration. The error node
+// returned takes the place of what was skipped.
+func (p *Parser) recover(start int, errors int, topLevel bool) *ErrorAST {
+	index := start
+
+	if p.furthest.token != nil && p.furthest.index > start {
+		index = p.furthest.index
+	}
+
+	if p.errors == errors {
+		if p.furthest.token == nil || p.furthest.index < start {
+			p.furthest = expectation{}
+			p.applyTokenIndex(start)
+			if topLevel {
+				p.expect("declaration")
+			} else {
+				p.expect("statement")
+			}
+		}
+
+		p.report(p.furthest.token, p.furthest.message())
+	} else {
+		// the error is in what parsed, such as a redefinition, so all of
+		// it is skipped
+		index = start
+	}
+
+	depth := 0
+
+	// a function body committed part way through is skipped from the
+	// commit, inside the body, as what came before it is gone
+	if start < p.committed {
+		start, depth = p.committed, 1
+
+		if index < start {
+			index = start
+		}
+	}
+
+	node := &ErrorAST{p.lastError, &BaseAST{ErrorID, p.tokenAt(start).Pos}}
+
+	p.applyTokenIndex(index)
+
+	for {
+		token := p.getToken()
+		cur := p.getCurIndex()
+
+		switch token.Type {
+		case TOK_EOF:
+			return node
+		case TOK_SEMICOLON:
+			if depth == 0 {
+				p.getNextToken()
+				return node
+			}
+		case TOK_LBRACE:
+			depth++
+		case TOK_RBRACE:
+			if depth == 0 && !topLevel {
+				return node
+			}
+
+			if depth <= 1 {
+				p.getNextToken()
+				return node
+			}
+
+			depth--
+		default:
+			if depth == 0 && cur > start && p.position(p.tokenAt(cur-1)).Line != p.position(&token).Line &&
+				(!topLevel || startsDeclaration(token.Type)) {
+				return node
+			}
+		}
+
+		// a source without an EOF token ends here too
+		if !p.getNextToken() || p.getCurIndex() == cur {
+			return node
+		}
+	}
+}
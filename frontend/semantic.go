@@ -0,0 +1,289 @@
+package frontend
+
+import (
+	"fmt"
+)
+
+// Checker performs the semantic checks that need the types of every
+// declaration in the translation unit, and resolves the functions named by
+// calls.
+type Checker struct {
+	globals   map[string]*VariableDeclAST
+	functions map[string]*PrototypeAST
+	locals    map[string]*VariableDeclAST
+	curFunc   string
+	ok        bool
+
+	// fset locates the nodes of the AST for Diagnostics; those without a
+	// position are reported in file
+	fset        *FileSet
+	file        string
+	Diagnostics DiagnosticList
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		globals:   make(map[string]*VariableDeclAST),
+		functions: make(map[string]*PrototypeAST),
+		locals:    make(map[string]*VariableDeclAST)}
+}
+
+func (c *Checker) Check(tunit *TranslationUnitAST) bool {
+	c.ok = true
+
+	for _, vdecl := range tunit.Variables {
+		c.globals[vdecl.Name] = vdecl
+	}
+
+	for _, proto := range tunit.Prototypes {
+		c.functions[proto.Name] = proto
+	}
+
+	for _, funcAST := range tunit.Functions {
+		c.functions[funcAST.Proto.Name] = funcAST.Proto
+	}
+
+	for _, vdecl := range tunit.Variables {
+		c.checkVariableDeclaration(vdecl)
+	}
+
+	for _, funcAST := range tunit.Functions {
+		c.checkFunctionDefinition(funcAST)
+	}
+
+	return c.ok
+}
+
+// errorf reports an error at pos.
+func (c *Checker) errorf(pos Pos, format string, args ...interface{}) {
+	c.Diagnostics = append(c.Diagnostics, &Diagnostic{c.position(pos), Severity_error, fmt.Sprintf(format, args...)})
+	c.ok = false
+}
+
+func (c *Checker) position(pos Pos) Position {
+	if c.fset != nil && pos.IsValid() {
+		return c.fset.Position(pos)
+	}
+
+	return Position{Filename: c.file}
+}
+
+// where describes the function being checked for diagnostics.
+func (c *Checker) where() string {
+	if c.curFunc == "" {
+		return ""
+	}
+
+	return " in function " + c.curFunc
+}
+
+func (c *Checker) warnf(pos Pos, format string, args ...interface{}) {
+	c.Diagnostics = append(c.Diagnostics, &Diagnostic{c.position(pos), Severity_warning, fmt.Sprintf(format, args...)})
+}
+
+func (c *Checker) checkFunctionDefinition(funcAST *FunctionAST) {
+	c.curFunc = funcAST.Proto.Name
+	c.locals = make(map[string]*VariableDeclAST)
+
+	for _, vdecl := range funcAST.Body.VariableDecls {
+		c.locals[vdecl.Name] = vdecl
+		c.checkVariableDeclaration(vdecl)
+	}
+
+	for _, stmt := range funcAST.Body.StmtLists {
+		c.checkExpression(stmt)
+	}
+}
+
+func (c *Checker) checkVariableDeclaration(vdecl *VariableDeclAST) {
+	if vdecl.Init != nil {
+		c.checkExpression(vdecl.Init)
+		c.checkConversion(vdecl.Init, vdecl.VarType, "initialization of "+vdecl.Name)
+	}
+}
+
+func (c *Checker) checkExpression(expr AST) {
+	switch expr.GetID() {
+	case BinaryExprID:
+		binExpr := expr.(*BinaryExprAST)
+		c.checkExpression(binExpr.LHS)
+		c.checkExpression(binExpr.RHS)
+
+		if ref, isRef := binExpr.LHS.(*FunctionRefAST); isRef && binExpr.Op == "=" {
+			// an undeclared name is reported by checkExpression
+			if c.functions[ref.Name] != nil {
+				c.errorf(binExpr.Pos, "Variable: assignment to function %s%s", ref.Name, c.where())
+			}
+		} else if binExpr.Op == "=" {
+			name := binExpr.LHS.(*VariableAST).Name
+			vdecl := c.lookupVariable(name)
+
+			if vdecl != nil && vdecl.VarType.Const {
+				c.errorf(binExpr.Pos, "Variable: assignment of read-only variable %s%s", name, c.where())
+			}
+
+			c.checkConversion(binExpr.RHS, c.typeOf(binExpr.LHS), "assignment to "+name)
+		} else if c.typeOf(binExpr.LHS).ID == Type_pointer || c.typeOf(binExpr.RHS).ID == Type_pointer {
+			c.errorf(binExpr.Pos, "Variable: invalid pointer operand to binary %s%s", binExpr.Op, c.where())
+		}
+	case CallExprID:
+		c.checkCallExpression(expr.(*CallExprAST))
+	case UnaryExprID:
+		unaryExpr := expr.(*UnaryExprAST)
+		c.checkExpression(unaryExpr.Operand)
+		operandType := c.typeOf(unaryExpr.Operand)
+
+		if unaryExpr.Op == "-" {
+			if operandType.ID == Type_pointer {
+				c.errorf(unaryExpr.Pos, "Variable: invalid pointer operand to unary -%s", c.where())
+			}
+		} else if operandType.ID != Type_pointer || operandType.Elem.ID != Type_function {
+			c.errorf(unaryExpr.Pos, "Variable: operand of unary * is not a function pointer%s", c.where())
+		}
+	case FunctionRefID:
+		if name := expr.(*FunctionRefAST).Name; c.functions[name] == nil {
+			c.errorf(expr.GetPos(), "Variable: undeclared identifier %s%s", name, c.where())
+		}
+	case AssertStmtID:
+		c.checkExpression(expr.(*AssertStmtAST).Expr)
+	case JumpStmtID:
+		jumpStmt := expr.(*JumpStmtAST)
+		c.checkExpression(jumpStmt.Expr)
+		c.checkConversion(jumpStmt.Expr, intType(), "return")
+	}
+}
+
+func (c *Checker) checkCallExpression(callExpr *CallExprAST) {
+	var funcType *TypeAST
+
+	callee := callExpr.Callee
+
+	if callExpr.Fn != nil {
+		c.checkExpression(callExpr.Fn)
+		callee = "function pointer"
+
+		if fnType := c.typeOf(callExpr.Fn); fnType.ID == Type_pointer && fnType.Elem.ID == Type_function {
+			funcType = fnType.Elem
+		} else {
+			c.errorf(callExpr.Fn.GetPos(), "Function: called object is not a function%s", c.where())
+		}
+	} else if proto := c.functions[callExpr.Callee]; proto != nil {
+		funcType = functionTypeOf(proto)
+	} else {
+		c.errorf(callExpr.Pos, "Function: call to undeclared function %s%s", callExpr.Callee, c.where())
+	}
+
+	if funcType != nil && (len(callExpr.Args) < len(funcType.Params) ||
+		(len(callExpr.Args) > len(funcType.Params) && !funcType.IsVarArg)) {
+		c.errorf(callExpr.Pos, "Function: %s expects %d arguments, but %d given%s",
+			callee, len(funcType.Params), len(callExpr.Args), c.where())
+		funcType = nil
+	}
+
+	for i, arg := range callExpr.Args {
+		c.checkExpression(arg)
+
+		if funcType != nil && i < len(funcType.Params) {
+			c.checkConversion(arg, funcType.Params[i], fmt.Sprintf("passing argument %d of %s", i+1, callee))
+		}
+	}
+}
+
+// checkConversion checks that the value of expr can be converted to type to
+// as if by assignment, reporting at expr. Converting a pointer to const to a
+// pointer whose target is not const only draws a warning.
+func (c *Checker) checkConversion(expr AST, to *TypeAST, context string) {
+	// an undeclared name has no type to convert
+	if ref, isRef := expr.(*FunctionRefAST); isRef && c.functions[ref.Name] == nil {
+		return
+	}
+
+	from := c.typeOf(expr)
+
+	if from.ID == Type_pointer && to.ID == Type_pointer {
+		if !compatibleType(from.Elem, to.Elem) {
+			c.errorf(expr.GetPos(), "Variable: incompatible pointer types in %s%s", context, c.where())
+		} else if from.Elem.Const && !to.Elem.Const {
+			c.warnf(expr.GetPos(), "%s%s discards const qualifier from pointer target type", context, c.where())
+		}
+	} else if from.ID == Type_pointer || to.ID == Type_pointer {
+		// 0 is the null pointer constant
+		if number, isNumber := expr.(*NumberAST); !isNumber || number.Val != 0 {
+			c.errorf(expr.GetPos(), "Variable: %s%s mixes pointer and integer", context, c.where())
+		}
+	}
+}
+
+func (c *Checker) lookupVariable(name string) *VariableDeclAST {
+	if vdecl, ok := c.locals[name]; ok {
+		return vdecl
+	}
+
+	return c.globals[name]
+}
+
+func (c *Checker) typeOf(expr AST) *TypeAST {
+	switch expr.GetID() {
+	case VariableID:
+		if vdecl := c.lookupVariable(expr.(*VariableAST).Name); vdecl != nil {
+			return vdecl.VarType
+		}
+	case StringID:
+		return pointerTo(&TypeAST{ID: Type_char})
+	case BinaryExprID:
+		if binExpr := expr.(*BinaryExprAST); binExpr.Op == "=" {
+			return c.typeOf(binExpr.LHS)
+		}
+	case FunctionRefID:
+		if proto := c.functions[expr.(*FunctionRefAST).Name]; proto != nil {
+			return pointerTo(functionTypeOf(proto))
+		}
+	case UnaryExprID:
+		// a function designator decays back to a pointer
+		if unaryExpr := expr.(*UnaryExprAST); unaryExpr.Op == "*" {
+			return c.typeOf(unaryExpr.Operand)
+		}
+	}
+
+	return intType()
+}
+
+// CheckMain reports whether tunit can be linked into a program on its own:
+// it must define main with external linkage and one of the signatures
+//
+//	int main(void)
+//	int main(int argc, char **argv)
+//
+// What is wrong is reported at main, in Diagnostics.
+func (c *Checker) CheckMain(tunit *TranslationUnitAST) bool {
+	var main *PrototypeAST
+
+	for _, funcAST := range tunit.Functions {
+		if funcAST.Proto.Name == "main" {
+			main = funcAST.Proto
+		}
+	}
+
+	if main == nil {
+		c.errorf(NoPos, "Function: main is not defined")
+		return false
+	}
+
+	if main.Storage == Storage_static {
+		c.errorf(main.Pos, "Function: main must not be static")
+		return false
+	}
+
+	argv := pointerTo(pointerTo(&TypeAST{ID: Type_char}))
+
+	if main.IsVarArg ||
+		!(len(main.ParamTypes) == 0 ||
+			(len(main.ParamTypes) == 2 &&
+				compatibleType(main.ParamTypes[0], intType()) &&
+				compatibleType(main.ParamTypes[1], argv))) {
+		c.errorf(main.Pos, "Function: main must be declared as int main(void) or int main(int argc, char **argv)")
+		return false
+	}
+
+	return true
+}
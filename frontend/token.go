@@ -7,22 +7,192 @@ import (
 type TokenType int
 
 const (
-	TOK_IDENTIFIER TokenType = 0
-	TOK_DIGIT      TokenType = 1
-	TOK_SYMBOL     TokenType = 2
-	TOK_INT        TokenType = 3
-	TOK_RETURN     TokenType = 4
-	TOK_EOF        TokenType = 5
+	TOK_IDENTIFIER TokenType = iota
+	TOK_DIGIT
+	TOK_STRING
+	TOK_EOF
+	TOK_ERROR
+
+	// keywords
+	TOK_INT
+	TOK_RETURN
+	TOK_CHAR
+	TOK_STATIC
+	TOK_EXTERN
+	TOK_CONST
+	TOK_VOID
+
+	// operators and punctuators
+	TOK_PLUS
+	TOK_MINUS
+	TOK_STAR
+	TOK_SLASH
+	TOK_ASSIGN
+	TOK_AMPERSAND
+	TOK_SEMICOLON
+	TOK_COMMA
+	TOK_ELLIPSIS
+	TOK_LPAREN
+	TOK_RPAREN
+	TOK_LBRACE
+	TOK_RBRACE
+	TOK_LBRACKET
+	TOK_RBRACKET
 )
 
+var tokenNames = [...]string{
+	TOK_IDENTIFIER: "IDENTIFIER",
+	TOK_DIGIT:      "DIGIT",
+	TOK_STRING:     "STRING",
+	TOK_EOF:        "EOF",
+	TOK_ERROR:      "ERROR",
+	TOK_INT:        "INT",
+	TOK_RETURN:     "RETURN",
+	TOK_CHAR:       "CHAR",
+	TOK_STATIC:     "STATIC",
+	TOK_EXTERN:     "EXTERN",
+	TOK_CONST:      "CONST",
+	TOK_VOID:       "VOID",
+	TOK_PLUS:       "PLUS",
+	TOK_MINUS:      "MINUS",
+	TOK_STAR:       "STAR",
+	TOK_SLASH:      "SLASH",
+	TOK_ASSIGN:     "ASSIGN",
+	TOK_AMPERSAND:  "AMPERSAND",
+	TOK_SEMICOLON:  "SEMICOLON",
+	TOK_COMMA:      "COMMA",
+	TOK_ELLIPSIS:   "ELLIPSIS",
+	TOK_LPAREN:     "LPAREN",
+	TOK_RPAREN:     "RPAREN",
+	TOK_LBRACE:     "LBRACE",
+	TOK_RBRACE:     "RBRACE",
+	TOK_LBRACKET:   "LBRACKET",
+	TOK_RBRACKET:   "RBRACKET",
+}
+
+func (t TokenType) String() string {
+	if 0 <= t && int(t) < len(tokenNames) {
+		return tokenNames[t]
+	}
+
+	return "TokenType(" + strconv.Itoa(int(t)) + ")"
+}
+
+var keywords = map[string]TokenType{
+	"int":    TOK_INT,
+	"return": TOK_RETURN,
+	"char":   TOK_CHAR,
+	"static": TOK_STATIC,
+	"extern": TOK_EXTERN,
+	"const":  TOK_CONST,
+	"void":   TOK_VOID,
+}
+
+// operators maps the spelling of every operator and punctuator to its kind.
+// The lexer takes the longest spelling that matches, so a multi-character
+// operator only needs an entry here.
+var operators = map[string]TokenType{
+	"+":   TOK_PLUS,
+	"-":   TOK_MINUS,
+	"*":   TOK_STAR,
+	"/":   TOK_SLASH,
+	"=":   TOK_ASSIGN,
+	"&":   TOK_AMPERSAND,
+	";":   TOK_SEMICOLON,
+	",":   TOK_COMMA,
+	"...": TOK_ELLIPSIS,
+	"(":   TOK_LPAREN,
+	")":   TOK_RPAREN,
+	"{":   TOK_LBRACE,
+	"}":   TOK_RBRACE,
+	"[":   TOK_LBRACKET,
+	"]":   TOK_RBRACKET,
+}
+
+// maxOperatorLength is the length of the longest operator, which is as far
+// as the lexer looks ahead from the start of a token.
+const maxOperatorLength = 3
+
+// tokenSpellings is the spelling of every keyword and operator kind, and
+// operatorIndex gives for each byte the kind of the one-byte operator it is,
+// if any, and the length of the longest operator starting with it.
+var tokenSpellings, operatorIndex = indexSpellings()
+
+type operatorEntry struct {
+	kind    TokenType
+	longest int
+}
+
+func indexSpellings() (spellings [len(tokenNames)]string, index [256]operatorEntry) {
+	for i := range index {
+		index[i].kind = TOK_ERROR
+	}
+
+	for spelling, kind := range keywords {
+		spellings[kind] = spelling
+	}
+
+	for spelling, kind := range operators {
+		spellings[kind] = spelling
+		entry := &index[spelling[0]]
+
+		if len(spelling) == 1 {
+			entry.kind = kind
+		}
+
+		if len(spelling) > entry.longest {
+			entry.longest = len(spelling)
+		}
+	}
+
+	return
+}
+
+// LookupKeyword returns the keyword kind of ident, or TOK_IDENTIFIER.
+func LookupKeyword(ident string) TokenType {
+	if tokenType, isKeyword := keywords[ident]; isKeyword {
+		return tokenType
+	}
+
+	return TOK_IDENTIFIER
+}
+
+// LookupOperator returns the kind and length of the longest operator or
+// punctuator at the start of s, or a length of 0 if there is none.
+func LookupOperator(s string) (TokenType, int) {
+	if len(s) == 0 {
+		return TOK_ERROR, 0
+	}
+
+	entry := operatorIndex[s[0]]
+
+	for n := entry.longest; n > 1; n-- {
+		if n <= len(s) {
+			if tokenType, ok := operators[s[:n]]; ok {
+				return tokenType, n
+			}
+		}
+	}
+
+	if entry.kind != TOK_ERROR {
+		return entry.kind, 1
+	}
+
+	return TOK_ERROR, 0
+}
+
+// Token is a lexeme of the source. Pos and End locate it in the FileSet of
+// its TokenSet, which resolves them to a file, line and column only when
+// asked. Trivia is kept apart from the tokens, by the TokenSet.
 type Token struct {
 	Type        TokenType
 	TokenString string
 	Number      int
-	Line        int
+	Pos         Pos
+	End         Pos
 }
 
-func NewToken(str string, tokenType TokenType, line int) *Token {
+func NewToken(str string, tokenType TokenType) *Token {
 	var number int
 
 	if tokenType == TOK_DIGIT {
@@ -34,6 +204,5 @@ func NewToken(str string, tokenType TokenType, line int) *Token {
 	return &Token{
 		Type:        tokenType,
 		TokenString: str,
-		Number:      number,
-		Line:        line}
+		Number:      number}
 }
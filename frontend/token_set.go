@@ -1,18 +1,56 @@
 package frontend
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
 )
 
+// TokenSource supplies tokens to the parser. The parser may back up to any
+// index at or after the one current at its last commit, which tells the
+// source that earlier tokens are no longer needed.
+type TokenSource interface {
+	getCurIndex() int
+	getCurType() TokenType
+	getCurString() string
+	getCurNumVal() int
+	getToken() Token
+	getNextToken() bool
+	applyTokenIndex(index int) bool
+	tokenAt(index int) *Token
+	commit()
+	fileSet() *FileSet
+	takeWarnings(index int) DiagnosticList
+}
+
 type TokenSet struct {
 	Tokens   []*Token
 	CurIndex int
+	FileSet  *FileSet
+
+	// source is what the tokens were lexed from when that was not the
+	// output of the preprocessor, so that Relex can apply edits to it
+	source *lexSource
+
+	// trivia is kept by token when lexing with Options.KeepTrivia
+	trivia []tokenTrivia
+
+	// Warnings holds the warnings of the preprocessor and the lexer
+	warningQueue
 }
 
 func NewTokenSet() *TokenSet {
 	var tokens []*Token
 
-	return &TokenSet{Tokens: tokens, CurIndex: 0}
+	return &TokenSet{Tokens: tokens, CurIndex: 0, FileSet: NewFileSet()}
+}
+
+// Position resolves the start of token in the FileSet of the tokens.
+func (t *TokenSet) Position(token *Token) Position {
+	return t.FileSet.Position(token.Pos)
 }
 
 func (t *TokenSet) pushToken(token *Token) bool {
@@ -55,6 +93,18 @@ func (t *TokenSet) getNextToken() (result bool) {
 	return
 }
 
+func (t *TokenSet) tokenAt(index int) *Token {
+	return t.Tokens[index]
+}
+
+// commit does nothing as a TokenSet holds every token anyway.
+func (t *TokenSet) commit() {
+}
+
+func (t *TokenSet) fileSet() *FileSet {
+	return t.FileSet
+}
+
 func (t *TokenSet) applyTokenIndex(index int) bool {
 	t.CurIndex = index
 
@@ -74,14 +124,96 @@ func (t *TokenSet) ungetToken(times int) bool {
 }
 
 func (t *TokenSet) PrintTokens() bool {
-	for _, token := range t.Tokens {
-		tokenType := token.Type
-		fmt.Printf("%d:", tokenType)
+	return t.WriteTokens(os.Stdout, FormatText) == nil
+}
+
+// Output formats of WriteTokens. FormatText is the "TYPE:text (line:column)"
+// listing of PrintTokens, FormatJSON writes one JSON object per token and
+// FormatTable lines the tokens up in columns.
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatTable = "table"
+)
+
+var TokenFormats = []string{FormatText, FormatJSON, FormatTable}
+
+// jsonToken is a token as FormatJSON writes it. Value is the number of a
+// constant or the unescaped contents of a string literal; the text of an
+// error token is its message. Value is only left out when it is nil, for the
+// other kinds, so a 0 or an empty string is still written.
+type jsonToken struct {
+	Kind   string      `json:"kind"`
+	Text   string      `json:"text"`
+	Value  interface{} `json:"value,omitempty"`
+	File   string      `json:"file"`
+	Line   int         `json:"line"`
+	Column int         `json:"column"`
+	Offset int         `json:"offset"`
+	End    int         `json:"end"`
+}
+
+// WriteTokens writes the tokens to w in format, one of TokenFormats.
+func (t *TokenSet) WriteTokens(w io.Writer, format string) error {
+	switch format {
+	case FormatText:
+		for _, token := range t.Tokens {
+			fmt.Fprintf(w, "%s:", token.Type)
+
+			if token.Type != TOK_EOF {
+				position := t.Position(token)
+				fmt.Fprintf(w, "%s (%d:%d)\n", token.TokenString, position.Line, position.Column)
+			}
+		}
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
 
-		if tokenType != TOK_EOF {
-			fmt.Printf("%s (%d)\n", token.TokenString, token.Line)
+		for _, token := range t.Tokens {
+			if err := encoder.Encode(t.jsonToken(token)); err != nil {
+				return err
+			}
+		}
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tTEXT\tVALUE\tPOSITION")
+
+		for _, token := range t.Tokens {
+			value := ""
+
+			switch v := t.jsonToken(token).Value.(type) {
+			case int:
+				value = strconv.Itoa(v)
+			case string:
+				value = strconv.Quote(v)
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", token.Type, strconv.Quote(token.TokenString), value,
+				t.Position(token))
 		}
+
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown token format %q", format)
 	}
 
-	return true
+	return nil
+}
+
+func (t *TokenSet) jsonToken(token *Token) jsonToken {
+	position := t.Position(token)
+	result := jsonToken{Kind: token.Type.String(), Text: token.TokenString, File: position.Filename,
+		Line: position.Line, Column: position.Column}
+
+	if f := t.FileSet.File(token.Pos); f != nil {
+		result.Offset, result.End = f.Offset(token.Pos), f.Offset(token.End)
+	}
+
+	switch token.Type {
+	case TOK_DIGIT:
+		result.Value = token.Number
+	case TOK_STRING:
+		result.Value, _ = unquoteString(token.TokenString)
+	}
+
+	return result
 }
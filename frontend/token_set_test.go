@@ -0,0 +1,45 @@
+package frontend
+
+import (
+	"bytes"
+	"github.com/coocood/assrt"
+	"testing"
+)
+
+func TestWriteTokens(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	tokens, err := LexString("t.xxx", "puts(\"a\\n\", 42);", &Options{})
+	assert.MustNil(err)
+
+	var out bytes.Buffer
+	assert.MustNil(tokens.WriteTokens(&out, FormatJSON))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.Equal(8, len(lines))
+	assert.Equal(`{"kind":"IDENTIFIER","text":"puts","file":"t.xxx","line":1,"column":1,"offset":0,"end":4}`, string(lines[0]))
+	assert.Equal(`{"kind":"STRING","text":"\"a\\n\"","value":"a\n","file":"t.xxx","line":1,"column":6,"offset":5,"end":10}`, string(lines[2]))
+	assert.Equal(`{"kind":"DIGIT","text":"42","value":42,"file":"t.xxx","line":1,"column":13,"offset":12,"end":14}`, string(lines[4]))
+	assert.Equal(`{"kind":"EOF","text":"","file":"t.xxx","line":1,"column":17,"offset":16,"end":16}`, string(lines[7]))
+
+	out.Reset()
+	assert.MustNil(tokens.WriteTokens(&out, FormatTable))
+
+	lines = bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.Equal("KIND        TEXT        VALUE  POSITION", string(lines[0]))
+	assert.Equal("STRING      \"\\\"a\\\\n\\\"\"  \"a\\n\"  t.xxx:1:6", string(lines[3]))
+	assert.Equal("DIGIT       \"42\"        42     t.xxx:1:13", string(lines[5]))
+
+	assert.NotNil(tokens.WriteTokens(&out, "xml"))
+
+	// a zero value is still written
+	tokens, err = LexString("t.xxx", "0 \"\"", &Options{})
+	assert.MustNil(err)
+
+	out.Reset()
+	assert.MustNil(tokens.WriteTokens(&out, FormatJSON))
+
+	lines = bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.Equal(`{"kind":"DIGIT","text":"0","value":0,"file":"t.xxx","line":1,"column":1,"offset":0,"end":1}`, string(lines[0]))
+	assert.Equal(`{"kind":"STRING","text":"\"\"","value":"","file":"t.xxx","line":1,"column":3,"offset":2,"end":4}`, string(lines[1]))
+}
@@ -0,0 +1,188 @@
+package frontend
+
+import (
+	"io"
+)
+
+// streamBufferSize is how many tokens the lexer may run ahead of the parser.
+const streamBufferSize = 64
+
+// TokenStream is a TokenSource fed by a lexer running in its own goroutine.
+// It only keeps the tokens the parser may still back up to, those read since
+// its last commit, so memory does not grow with the length of the input.
+// Error tokens are collected in Errors rather than handed to the parser.
+type TokenStream struct {
+	items   chan lexItem
+	done    chan struct{}
+	buf     []*Token
+	base    int
+	cur     int
+	closed  bool
+	FileSet *FileSet
+	Errors  DiagnosticList
+
+	// Warnings holds the warnings of the preprocessor and the lexer read so
+	// far
+	warningQueue
+
+	// MaxBuffered is the largest number of tokens held at once.
+	MaxBuffered int
+}
+
+// lexItem is what a concurrent lexer sends its TokenStream: a token, or a
+// diagnostic of the preprocessor or the lexer other than an error token.
+type lexItem struct {
+	token      *Token
+	diagnostic *Diagnostic
+}
+
+// LexStream reads the source from r and starts preprocessing and lexing it
+// concurrently, a few lines ahead of the tokens read from the stream.
+// Preprocessing errors end the tokens and are collected in Errors. The
+// stream must be closed when no longer needed.
+func LexStream(name string, r io.Reader, opts *Options) (*TokenStream, error) {
+	opts = opts.orDefault()
+	lexer, err := newLexerFor(name, r, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lexer.items = make(chan lexItem, streamBufferSize)
+	lexer.done = make(chan struct{})
+
+	stream := &TokenStream{items: lexer.items, done: lexer.done, FileSet: lexer.tokens.FileSet}
+
+	go lexer.run()
+
+	return stream, nil
+}
+
+// ParseStream is Parse with the lexer running concurrently with the parser.
+func ParseStream(name string, r io.Reader, opts *Options) (*TranslationUnitAST, error) {
+	opts = opts.orDefault()
+	stream, err := LexStream(name, r, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	parser := NewParserFromSource(stream, opts)
+	ok := parser.DoParse()
+
+	// a lexical error explains a parse failure better than the parser can
+	if len(stream.Errors) > 0 {
+		return nil, stream.Errors
+	}
+
+	if !ok {
+		return nil, parser.Diagnostics
+	}
+
+	return parser.GetAST(), nil
+}
+
+func (s *TokenStream) fileSet() *FileSet {
+	return s.FileSet
+}
+
+// Close stops the lexer if it has not reached the end of the input.
+func (s *TokenStream) Close() {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+}
+
+// fill reads tokens until index is buffered, and reports whether it is.
+func (s *TokenStream) fill(index int) bool {
+	for !s.closed && index >= s.base+len(s.buf) {
+		item, ok := <-s.items
+		token := item.token
+
+		if !ok {
+			s.closed = true
+		} else if item.diagnostic != nil && item.diagnostic.Severity == Severity_error {
+			s.Errors = append(s.Errors, item.diagnostic)
+		} else if item.diagnostic != nil {
+			s.addWarning(s.base+len(s.buf), item.diagnostic)
+		} else if token.Type == TOK_ERROR {
+			s.Errors = append(s.Errors, &Diagnostic{s.FileSet.Position(token.Pos), Severity_error, token.TokenString})
+		} else {
+			s.buf = append(s.buf, token)
+
+			if len(s.buf) > s.MaxBuffered {
+				s.MaxBuffered = len(s.buf)
+			}
+		}
+	}
+
+	return index < s.base+len(s.buf)
+}
+
+func (s *TokenStream) tokenAt(index int) *Token {
+	if index < s.base {
+		panic("frontend: token before the last commit")
+	}
+
+	if !s.fill(index) {
+		// the lexer ends with an EOF token unless it stopped on an error
+		if last := len(s.buf) - 1; last >= 0 && s.buf[last].Type == TOK_EOF {
+			return s.buf[last]
+		}
+
+		return &Token{Type: TOK_EOF}
+	}
+
+	return s.buf[index-s.base]
+}
+
+func (s *TokenStream) getCurIndex() int {
+	return s.cur
+}
+
+func (s *TokenStream) getCurType() TokenType {
+	return s.tokenAt(s.cur).Type
+}
+
+func (s *TokenStream) getCurString() string {
+	return s.tokenAt(s.cur).TokenString
+}
+
+func (s *TokenStream) getCurNumVal() int {
+	return s.tokenAt(s.cur).Number
+}
+
+func (s *TokenStream) getToken() Token {
+	return *s.tokenAt(s.cur)
+}
+
+func (s *TokenStream) getNextToken() bool {
+	if !s.fill(s.cur + 1) {
+		return false
+	}
+
+	s.cur++
+
+	return true
+}
+
+func (s *TokenStream) applyTokenIndex(index int) bool {
+	if index < s.base {
+		panic("frontend: backtracking before the last commit")
+	}
+
+	s.cur = index
+
+	return true
+}
+
+// commit drops the tokens before the current one.
+func (s *TokenStream) commit() {
+	if s.cur > s.base {
+		s.buf = append(s.buf[:0], s.buf[s.cur-s.base:]...)
+		s.base = s.cur
+	}
+}
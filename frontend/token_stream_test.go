@@ -0,0 +1,149 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coocood/assrt"
+	"strings"
+	"testing"
+)
+
+// generateSource returns a translation unit of n small functions, each
+// calling the one before.
+func generateSource(n int) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("int f0(int a, int b) {\n  return a;\n}\n")
+
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&buf, "int f%d(int a, int b) {\n  int c;\n  c = f%d(a, b) * b;\n  return c - 1;\n}\n", i, i-1)
+	}
+
+	return buf.String()
+}
+
+func TestParseStream(t *testing.T) {
+	assert := assrt.NewAssert(t)
+	src := generateSource(500)
+
+	expected, err := ParseString("gen.xxx", src, &Options{})
+	assert.MustNil(err)
+
+	stream, err := LexStream("gen.xxx", strings.NewReader(src), &Options{})
+	assert.MustNil(err)
+
+	parser := NewParserFromSource(stream, &Options{})
+	assert.MustTrue(parser.DoParse())
+	stream.Close()
+
+	assert.Equal(expected, parser.GetAST())
+
+	// only about one function's tokens are held at a time
+	assert.True(stream.MaxBuffered < 64)
+
+	_, err = ParseStream("gen.xxx", strings.NewReader(src+"int g(void) {\n  return 1 @ 2;\n}\n"), &Options{})
+	assert.MustNotNil(err)
+	assert.Equal("gen.xxx:2500:12: error: invalid character '@'", err.Error())
+
+	// a preprocessing error far into the source ends the stream there
+	_, ppErr := ParseString("gen.xxx", src+"#if 1\n", &Options{})
+	assert.MustNotNil(ppErr)
+
+	_, err = ParseStream("gen.xxx", strings.NewReader(src+"#if 1\n"), &Options{})
+	assert.MustNotNil(err)
+	assert.Equal(ppErr.Error(), err.Error())
+}
+
+// generateFunction returns a translation unit of one function of n
+// statements.
+func generateFunction(n int) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("int main(void) {\n  int c;\n  c = 0;\n")
+
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&buf, "  c = c + %d;\n", i)
+	}
+
+	buf.WriteString("  return c;\n}\n")
+
+	return buf.String()
+}
+
+func TestParseStreamLongFunction(t *testing.T) {
+	assert := assrt.NewAssert(t)
+
+	// the parser commits between the statements of a long function body
+	for _, src := range []string{generateFunction(5000), generateFunction(5000) + "int f(void) {\n  return 0;\n}\n"} {
+		expected, err := ParseString("gen.xxx", src, &Options{})
+		assert.MustNil(err)
+
+		stream, err := LexStream("gen.xxx", strings.NewReader(src), &Options{})
+		assert.MustNil(err)
+
+		parser := NewParserFromSource(stream, &Options{})
+		assert.MustTrue(parser.DoParse())
+		stream.Close()
+
+		assert.Equal(expected, parser.GetAST())
+		assert.True(stream.MaxBuffered < 2*maxUncommitted)
+	}
+
+	// an error in the body is still recovered from, also when the function
+	// only fails at its end, after its start was committed
+	for _, src := range []string{
+		strings.Replace(generateFunction(5000), "c + 4000", "c + + ;", 1),
+		strings.Replace(generateFunction(5000), "  return c;\n", "", 1),
+	} {
+		_, expected := ParseString("gen.xxx", src+"int f(void) {\n  return 0;\n}\n", &Options{})
+		assert.MustNotNil(expected)
+
+		_, err := ParseStream("gen.xxx", strings.NewReader(src+"int f(void) {\n  return 0;\n}\n"), &Options{})
+		assert.Equal(expected.Error(), err.Error())
+	}
+}
+
+func BenchmarkParseWhole(b *testing.B) {
+	src := generateSource(5000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tokens, _ := LexString("gen.xxx", src, &Options{})
+		NewParserFromTokens(tokens, &Options{}).DoParse()
+		b.ReportMetric(float64(len(tokens.Tokens)), "tokens-held")
+	}
+}
+
+func BenchmarkParseStream(b *testing.B) {
+	src := generateSource(5000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		stream, _ := LexStream("gen.xxx", strings.NewReader(src), &Options{})
+		NewParserFromSource(stream, &Options{}).DoParse()
+		stream.Close()
+		b.ReportMetric(float64(stream.MaxBuffered), "tokens-held")
+	}
+}
+
+// The first token benchmarks measure the latency until the parser can start.
+func BenchmarkFirstTokenWhole(b *testing.B) {
+	src := generateSource(5000)
+
+	for i := 0; i < b.N; i++ {
+		tokens, _ := LexString("gen.xxx", src, &Options{})
+		tokens.getCurType()
+	}
+}
+
+func BenchmarkFirstTokenStream(b *testing.B) {
+	src := generateSource(5000)
+
+	for i := 0; i < b.N; i++ {
+		stream, _ := LexStream("gen.xxx", strings.NewReader(src), &Options{})
+		stream.getCurType()
+		stream.Close()
+	}
+}
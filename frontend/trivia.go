@@ -0,0 +1,74 @@
+package frontend
+
+import (
+	"strings"
+)
+
+type TriviaKind int
+
+const (
+	Trivia_space     TriviaKind = 0
+	Trivia_newline   TriviaKind = 1
+	Trivia_comment   TriviaKind = 2
+	Trivia_directive TriviaKind = 3
+	Trivia_skipped   TriviaKind = 4
+	Trivia_bom       TriviaKind = 5
+)
+
+// Trivia is source text between tokens: whitespace, a comment, a
+// preprocessing directive when lexing without preprocessing, text an error
+// token rejected, or the byte order mark at the start of the source.
+type Trivia struct {
+	Kind TriviaKind
+	Text string
+}
+
+// tokenTrivia is the trivia around one token of a TokenSet. Trailing trivia
+// runs up to the end of the token's line and everything after that leads
+// the next token.
+type tokenTrivia struct {
+	leading  []Trivia
+	trailing []Trivia
+}
+
+// Leading returns the trivia before token i, which is only kept when lexing
+// with Options.KeepTrivia.
+func (t *TokenSet) Leading(i int) []Trivia {
+	if i < len(t.trivia) {
+		return t.trivia[i].leading
+	}
+
+	return nil
+}
+
+// Trailing returns the trivia after token i on its line, which is only kept
+// when lexing with Options.KeepTrivia.
+func (t *TokenSet) Trailing(i int) []Trivia {
+	if i < len(t.trivia) {
+		return t.trivia[i].trailing
+	}
+
+	return nil
+}
+
+// FullText returns the source text of token i with its trivia. An error
+// token has no text of its own; what it rejected is its first trailing
+// trivia. Concatenating the full text of every token of a lossless lexing
+// reproduces the input.
+func (t *TokenSet) FullText(i int) string {
+	var text strings.Builder
+
+	for _, trivia := range t.Leading(i) {
+		text.WriteString(trivia.Text)
+	}
+
+	if t.Tokens[i].Type != TOK_ERROR {
+		text.WriteString(t.Tokens[i].TokenString)
+	}
+
+	for _, trivia := range t.Trailing(i) {
+		text.WriteString(trivia.Text)
+	}
+
+	return text.String()
+}
@@ -1,16 +1,32 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"llvm_study/frontend"
 	"os"
+	"strings"
 )
 
 func main() {
-	filename := os.Args[1]
+	var options frontend.Options
 
-	tokens := frontend.LexicalAnalysis(filename)
+	options.SetFlags(flag.CommandLine)
+	format := flag.String("format", frontend.FormatText, "token output `format`: "+strings.Join(frontend.TokenFormats, ", "))
+	flag.CommandLine.Parse(frontend.SplitShortFlags(os.Args[1:]))
 
-	if tokens != nil {
-		tokens.PrintTokens()
+	filename := flag.Arg(0)
+
+	tokens := frontend.LexicalAnalysisWithOptions(filename, &options)
+
+	if tokens == nil {
+		os.Exit(1)
+	}
+
+	frontend.PrintError(os.Stderr, tokens.Warnings)
+
+	if err := tokens.WriteTokens(os.Stdout, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 }
@@ -2,15 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"llvm_study/frontend"
 	"os"
 )
 
 func main() {
-	filename := os.Args[1]
+	var options frontend.Options
+
+	options.SetFlags(flag.CommandLine)
+	flag.CommandLine.Parse(frontend.SplitShortFlags(os.Args[1:]))
+
+	filename := flag.Arg(0)
+
+	parser := frontend.NewParserWithOptions(filename, &options)
+	ok := parser.DoParse()
+	frontend.PrintError(os.Stderr, parser.Diagnostics)
+
+	if !ok {
+		os.Exit(1)
+	}
 
-	parser := frontend.NewParser(filename)
-	parser.DoParse()
 	ast := parser.GetAST()
 
 	json.NewEncoder(os.Stdout).Encode(ast)